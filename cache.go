@@ -0,0 +1,263 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache key of a request, replies differ in DNSSEC records and validation
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+func newCacheKey(state *request.Request) cacheKey {
+	opt := state.Req.IsEdns0()
+	return cacheKey{
+		name:   strings.ToLower(state.QName()),
+		qtype:  state.QType(),
+		qclass: state.QClass(),
+		do:     opt != nil && opt.Do(),
+		cd:     state.Req.CheckingDisabled,
+	}
+}
+
+// Also used as the key of in-flight requests, see: reloadableUpstream.inflight
+func (k cacheKey) String() string {
+	return fmt.Sprintf("%v %v %v %v %v", k.qtype, k.qclass, k.do, k.cd, k.name)
+}
+
+type cacheEntry struct {
+	key cacheKey
+	// Reply without OPT record, which is rebuilt for each request
+	// TTL of each record is clamped by min_ttl and max_ttl, and decreased by time elapsed once served
+	reply  *dns.Msg
+	stored time.Time
+	// Minimal TTL of records, the entry expires after it
+	ttl time.Duration
+	// Number of hits since stored, thus an entry is prefetched again only if it's still popular
+	hits int
+	// Set once a prefetch is kicked off, reset by the refreshed entry or on prefetch failure
+	prefetching bool
+}
+
+// Per-block LRU response cache, see: cache, min_ttl, max_ttl, prefetch and serve_stale
+type replyCache struct {
+	sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+
+	// Maximum number of entries, zero if the cache is disabled
+	capacity int
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	// Prefetch an entry if it's hit at least `prefetch' times, and its remaining TTL
+	// is less than `prefetchPercent' percent of the TTL, zero to disable
+	prefetch        int
+	prefetchPercent int
+	// Serve entries expired within this duration if all upstreams failed, zero to disable
+	serveStale time.Duration
+	// Flag indicate any cache option is specified
+	configured bool
+}
+
+func newReplyCache() *replyCache {
+	return &replyCache{
+		maxTTL:          defaultCacheMaxTTL,
+		prefetchPercent: defaultPrefetchPercent,
+	}
+}
+
+func (c *replyCache) init() {
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru = list.New()
+}
+
+// Return the response cache for the request, nil if the cache is disabled
+// Only standard queries are cached, others(e.g. UPDATE, NOTIFY) must always reach the upstream
+func (u *reloadableUpstream) cacheFor(state *request.Request) *replyCache {
+	if u.cache == nil || state.Req.Opcode != dns.OpcodeQuery {
+		return nil
+	}
+	return u.cache
+}
+
+// Return TTL of the reply, i.e. the minimal TTL of its records
+// Return false if the reply isn't cacheable
+func replyTTL(m *dns.Msg) (time.Duration, bool) {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			t := recordTTL(m, rr)
+			if !found || t < ttl {
+				ttl = t
+				found = true
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second, found
+}
+
+// Return TTL of the record in the reply
+// For negative replies, the SOA record limits the TTL by its MINIMUM field, see: RFC 2308
+func recordTTL(m *dns.Msg, rr dns.RR) uint32 {
+	t := rr.Header().Ttl
+	if soa, ok := rr.(*dns.SOA); ok && len(m.Answer) == 0 && soa.Minttl < t {
+		t = soa.Minttl
+	}
+	return t
+}
+
+// Clamp the TTL by min_ttl and max_ttl
+func (c *replyCache) clampTTL(ttl time.Duration) time.Duration {
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
+}
+
+// Cache the reply of the request, uncacheable replies are skipped
+// Return true if the reply is cached
+func (c *replyCache) set(key cacheKey, reply *dns.Msg, now time.Time) bool {
+	ttl, ok := replyTTL(reply)
+	if !ok {
+		return false
+	}
+	// Truncated as TTL of records, see below
+	ttl = c.clampTTL(ttl).Truncate(time.Second)
+	if ttl < time.Second {
+		return false
+	}
+
+	m := reply.Copy()
+	removeOPT(m)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			rr.Header().Ttl = uint32(c.clampTTL(time.Duration(recordTTL(m, rr))*time.Second) / time.Second)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	e := &cacheEntry{key: key, reply: m, stored: now, ttl: ttl}
+	if elem, found := c.entries[key]; found {
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return true
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return true
+}
+
+// Allow the entry to be prefetched again, called if the prefetch failed or its reply isn't cacheable
+func (c *replyCache) prefetchFailed(key cacheKey) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, found := c.entries[key]; found {
+		elem.Value.(*cacheEntry).prefetching = false
+	}
+}
+
+// Return a copy of the cached reply for the request, nil if not found or expired
+// If `stale' is true, entries expired within serve_stale are returned as well
+// The second return value denotes if the entry should be prefetched
+func (c *replyCache) get(state *request.Request, key cacheKey, now time.Time, stale bool) (*dns.Msg, bool) {
+	c.Lock()
+	elem, found := c.entries[key]
+	if !found {
+		c.Unlock()
+		return nil, false
+	}
+	e := elem.Value.(*cacheEntry)
+	remaining := e.ttl - now.Sub(e.stored)
+	if remaining <= 0 {
+		if -remaining >= c.serveStale {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+			c.Unlock()
+			return nil, false
+		}
+		if !stale {
+			c.Unlock()
+			return nil, false
+		}
+	}
+	e.hits++
+	c.lru.MoveToFront(elem)
+	prefetch := false
+	if !stale && c.prefetch != 0 && !e.prefetching && e.hits >= c.prefetch &&
+		remaining*100 < e.ttl*time.Duration(c.prefetchPercent) {
+		e.prefetching = true
+		prefetch = true
+	}
+	reply := e.reply
+	stored := e.stored
+	c.Unlock()
+
+	// Rounded down, thus TTL of records of a fresh reply never goes zero
+	elapsed := int64(now.Sub(stored) / time.Second)
+	// Entries are never altered once stored, it's safe to copy without lock
+	m := reply.Copy()
+	m.Id = state.Req.Id
+	m.Question = []dns.Question{state.Req.Question[0]}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			ttl := int64(hdr.Ttl) - elapsed
+			if remaining <= 0 && (ttl <= 0 || ttl > staleReplyTTL) {
+				ttl = staleReplyTTL
+			}
+			hdr.Ttl = uint32(ttl)
+		}
+	}
+	state.SizeAndDo(m)
+	return m, prefetch
+}
+
+// Remove the OPT record, which is rebuilt for each request, see: request.Request.SizeAndDo()
+func removeOPT(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+const (
+	defaultCacheCapacity   = 10000
+	defaultCacheMaxTTL     = 1 * time.Hour
+	defaultPrefetchPercent = 10
+	defaultServeStale      = 1 * time.Hour
+	// TTL of stale replies, see: RFC 8767 section 4
+	staleReplyTTL = 30
+)
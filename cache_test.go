@@ -0,0 +1,301 @@
+package dnsredir
+
+import (
+	"context"
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplyTTL(t *testing.T) {
+	tests := []struct {
+		rcode     int
+		answer    []string
+		ns        []string
+		ttl       time.Duration
+		cacheable bool
+	}{
+		{dns.RcodeSuccess, []string{"example.com. 300 IN A 1.1.1.1", "example.com. 60 IN A 1.0.0.1"}, nil, 60 * time.Second, true},
+		{dns.RcodeNameError, nil, []string{"com. 900 IN SOA a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400"}, 900 * time.Second, true},
+		{dns.RcodeSuccess, nil, []string{"com. 900 IN SOA a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 120"}, 120 * time.Second, true},
+		{dns.RcodeSuccess, nil, nil, 0, false},
+		{dns.RcodeServerFailure, []string{"example.com. 300 IN A 1.1.1.1"}, nil, 0, false},
+	}
+	for i, test := range tests {
+		m := newTestReply(t, test.answer...)
+		m.Ns = newTestReply(t, test.ns...).Answer
+		m.Rcode = test.rcode
+		ttl, ok := replyTTL(m)
+		if ok != test.cacheable || (ok && ttl != test.ttl) {
+			t.Errorf("Test case#%v failed, got %v %v, expected %v %v", i, ttl, ok, test.ttl, test.cacheable)
+		}
+	}
+}
+
+func TestReplyCache(t *testing.T) {
+	c := newReplyCache()
+	c.capacity = 2
+	c.minTTL = 10 * time.Second
+	c.prefetch = 2
+	c.prefetchPercent = 20
+	c.serveStale = time.Minute
+	c.init()
+
+	now := time.Now()
+	state := newTestRequest("Example.COM", dns.TypeA)
+	state.Req.Id = 1234
+	key := newCacheKey(state)
+	reply := newTestReply(t, "example.com. 5 IN A 1.1.1.1")
+	reply.SetEdns0(4096, false)
+	c.set(key, reply, now)
+
+	// Clamped by min_ttl, OPT record is stripped since the request has none
+	m, prefetch := c.get(state, key, now.Add(2*time.Second), false)
+	if m == nil || m.Id != 1234 || m.Answer[0].Header().Ttl != 8 || m.IsEdns0() != nil || prefetch {
+		t.Fatalf("Unexpected cached reply: %v, prefetch: %v", m, prefetch)
+	}
+	if m.Question[0].Name != "Example.COM." {
+		t.Errorf("Question of the request isn't kept: %v", m.Question[0])
+	}
+	// Hit twice and less than 20% TTL remains
+	if _, prefetch := c.get(state, key, now.Add(8500*time.Millisecond), false); !prefetch {
+		t.Errorf("Expected prefetch")
+	}
+	if _, prefetch := c.get(state, key, now.Add(8500*time.Millisecond), false); prefetch {
+		t.Errorf("Prefetch should be kicked off only once")
+	}
+
+	// Expired, only served as stale
+	if m, _ := c.get(state, key, now.Add(20*time.Second), false); m != nil {
+		t.Errorf("Expired reply served: %v", m)
+	}
+	if m, _ := c.get(state, key, now.Add(20*time.Second), true); m == nil || m.Answer[0].Header().Ttl != staleReplyTTL {
+		t.Errorf("Unexpected stale reply: %v", m)
+	}
+	if m, _ := c.get(state, key, now.Add(80*time.Second), true); m != nil {
+		t.Errorf("Reply expired beyond serve_stale served: %v", m)
+	}
+
+	// DO bit is a part of the key
+	state.Req.SetEdns0(4096, true)
+	doKey := newCacheKey(state)
+	if m, _ := c.get(state, doKey, now, false); m != nil {
+		t.Errorf("Reply of request without DO bit served: %v", m)
+	}
+
+	// Least recently used entry is evicted
+	c.set(doKey, reply, now)
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		c.set(newCacheKey(newTestRequest(name, dns.TypeA)), reply, now)
+	}
+	if c.lru.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %v", c.lru.Len())
+	}
+	if m, _ := c.get(state, doKey, now, false); m != nil {
+		t.Errorf("Evicted reply served: %v", m)
+	}
+}
+
+func TestReplyCacheRecordTTL(t *testing.T) {
+	c := newReplyCache()
+	c.capacity = 10
+	c.maxTTL = 200 * time.Second
+	c.serveStale = time.Hour
+	c.init()
+
+	now := time.Now()
+	state := newTestRequest("example.com", dns.TypeA)
+	key := newCacheKey(state)
+	reply := newTestReply(t, "example.com. 300 IN A 1.1.1.1", "example.com. 60 IN A 1.0.0.1")
+	reply.Ns = newTestReply(t, "example.com. 100 IN NS a.iana-servers.net.").Answer
+	c.set(key, reply, now)
+
+	tests := []struct {
+		elapsed time.Duration
+		stale   bool
+		ttls    []uint32
+	}{
+		// Each record keeps its own TTL, clamped by max_ttl
+		{10500 * time.Millisecond, false, []uint32{190, 50, 90}},
+		{59 * time.Second, false, []uint32{141, 1, 41}},
+		// Stale records are clamped at staleReplyTTL
+		{70 * time.Second, true, []uint32{staleReplyTTL, staleReplyTTL, staleReplyTTL}},
+		{185 * time.Second, true, []uint32{15, staleReplyTTL, staleReplyTTL}},
+	}
+	for i, test := range tests {
+		m, _ := c.get(state, key, now.Add(test.elapsed), test.stale)
+		if m == nil {
+			t.Errorf("Test case#%v failed, reply not found", i)
+			continue
+		}
+		ttls := []uint32{m.Answer[0].Header().Ttl, m.Answer[1].Header().Ttl, m.Ns[0].Header().Ttl}
+		if fmt.Sprint(ttls) != fmt.Sprint(test.ttls) {
+			t.Errorf("Test case#%v failed, got TTLs %v, expected %v", i, ttls, test.ttls)
+		}
+	}
+	if m, _ := c.get(state, key, now.Add(60*time.Second), false); m != nil {
+		t.Errorf("Expired reply served: %v", m)
+	}
+}
+
+func TestReplyCachePrefetch(t *testing.T) {
+	c := newReplyCache()
+	c.capacity = 10
+	c.prefetch = 2
+	c.prefetchPercent = 50
+	c.init()
+
+	now := time.Now()
+	state := newTestRequest("example.com", dns.TypeA)
+	key := newCacheKey(state)
+	reply := newTestReply(t, "example.com. 10 IN A 1.1.1.1")
+	c.set(key, reply, now)
+
+	at := now.Add(6 * time.Second)
+	c.get(state, key, at, false)
+	if _, prefetch := c.get(state, key, at, false); !prefetch {
+		t.Fatalf("Expected prefetch")
+	}
+	if _, prefetch := c.get(state, key, at, false); prefetch {
+		t.Errorf("Prefetch should be kicked off only once")
+	}
+	// Prefetched again once the previous prefetch failed
+	c.prefetchFailed(key)
+	if _, prefetch := c.get(state, key, at, false); !prefetch {
+		t.Errorf("Expected prefetch after the previous prefetch failed")
+	}
+
+	// Hits aren't carried over to the refreshed entry
+	c.set(key, reply, at)
+	if _, prefetch := c.get(state, key, at.Add(6*time.Second), false); prefetch {
+		t.Errorf("Refreshed entry prefetched before it's hit %v times", c.prefetch)
+	}
+	if _, prefetch := c.get(state, key, at.Add(6*time.Second), false); !prefetch {
+		t.Errorf("Expected prefetch of the refreshed entry")
+	}
+}
+
+func TestSetupCache(t *testing.T) {
+	tests := []testCase{
+		{"dnsredir . {\n to 1.1.1.1\n cache\n min_ttl 30s\n max_ttl 10m\n prefetch 3 20%\n serve_stale 1d\n}", true, "unknown unit"},
+		{"dnsredir . {\n to 1.1.1.1\n cache 0\n}", true, "isn't a positive integer"},
+		{"dnsredir . {\n to 1.1.1.1\n min_ttl 30s\n}", true, "require"},
+		{"dnsredir . {\n to 1.1.1.1\n cache\n min_ttl 1h\n max_ttl 10m\n}", true, "is greater than"},
+		{"dnsredir . {\n to 1.1.1.1\n cache\n max_ttl 0\n}", true, "minimal TTL"},
+		{"dnsredir . {\n to 1.1.1.1\n cache\n prefetch 3 200%\n}", true, "isn't a valid percentage"},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := newReloadableUpstream(c)
+		if !test.Pass(err) {
+			t.Errorf("Test#%v failed  %v vs err: %v", i, test, err)
+		}
+	}
+
+	c := caddy.NewTestController("dns", "dnsredir . {\n to 1.1.1.1\n cache 100\n min_ttl 30s\n prefetch 3 20%\n serve_stale\n}")
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed: %v", err)
+	}
+	cache := up.(*reloadableUpstream).cache
+	if cache == nil || cache.capacity != 100 || cache.minTTL != 30*time.Second || cache.maxTTL != defaultCacheMaxTTL ||
+		cache.prefetch != 3 || cache.prefetchPercent != 20 || cache.serveStale != defaultServeStale {
+		t.Errorf("Unexpected cache settings: %+v", cache)
+	}
+}
+
+func TestCacheServeDNS(t *testing.T) {
+	ts := startTestServer(t, "93.184.216.34")
+	input := fmt.Sprintf(`
+dnsredir . {
+	to %v
+	health_check 0
+	max_retry 1
+	cache
+	max_ttl 1s
+	serve_stale
+}
+`, ts.addr)
+	c := caddy.NewTestController("dns", input)
+	c.Next()
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed: %v", err)
+	}
+	up.(*reloadableUpstream).HealthCheck.Start()
+	defer up.(*reloadableUpstream).HealthCheck.Stop()
+	r := &Dnsredir{Upstreams: &[]Upstream{up}}
+
+	serve := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("ServeDNS() failed: %v", err)
+		}
+		if rec.Msg == nil || rec.Msg.Id != req.Id || len(rec.Msg.Answer) != 1 {
+			t.Fatalf("Unexpected reply: %v", rec.Msg)
+		}
+		return rec.Msg
+	}
+
+	serve()
+	serve()
+	if n := atomic.LoadInt32(&ts.queries); n != 1 {
+		t.Errorf("Expected 1 upstream query, got %v", n)
+	}
+
+	// Expired, and the upstream fails
+	time.Sleep(1100 * time.Millisecond)
+	atomic.StoreInt32(&ts.drop, 1)
+	if m := serve(); m.Answer[0].Header().Ttl != staleReplyTTL {
+		t.Errorf("Expected stale reply, got %v", m)
+	}
+	if n := atomic.LoadInt32(&ts.queries); n != 2 {
+		t.Errorf("Expected 2 upstream queries, got %v", n)
+	}
+}
+
+func TestCacheOpcode(t *testing.T) {
+	ts := startTestServer(t, "93.184.216.34")
+	input := fmt.Sprintf("dnsredir . {\n to %v\n health_check 0\n cache\n}", ts.addr)
+	c := caddy.NewTestController("dns", input)
+	c.Next()
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed: %v", err)
+	}
+	up.(*reloadableUpstream).HealthCheck.Start()
+	defer up.(*reloadableUpstream).HealthCheck.Stop()
+	r := &Dnsredir{Upstreams: &[]Upstream{up}}
+
+	tests := []struct {
+		opcode  int
+		queries int32 // Expected upstream queries after served
+	}{
+		{dns.OpcodeQuery, 1},
+		{dns.OpcodeQuery, 1},
+		// Never answered from the cache, nor cached
+		{dns.OpcodeNotify, 2},
+		{dns.OpcodeUpdate, 3},
+		{dns.OpcodeUpdate, 4},
+		{dns.OpcodeQuery, 4},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.Opcode = test.opcode
+		rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test case#%v failed, ServeDNS(): %v", i, err)
+		}
+		if n := atomic.LoadInt32(&ts.queries); n != test.queries {
+			t.Errorf("Test case#%v failed, expected %v upstream queries, got %v", i, test.queries, n)
+		}
+	}
+}
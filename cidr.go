@@ -0,0 +1,169 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Set of CIDRs, a lookup probes once per distinct prefix length, regardless of the set size
+type cidrSet struct {
+	prefixes map[netip.Prefix]struct{}
+	// Distinct prefix lengths in ascending order, per address family
+	bits4 []int
+	bits6 []int
+}
+
+func newCidrSet() *cidrSet {
+	return &cidrSet{prefixes: make(map[netip.Prefix]struct{})}
+}
+
+// Parse a CIDR or a single IP address, IPv4-mapped IPv6 addresses are taken as IPv4
+func parseCidrPrefix(s string) (netip.Prefix, bool) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), addr.Zone() == ""
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	if p.Addr().Is4In6() {
+		if p.Bits() < 96 {
+			return netip.Prefix{}, false
+		}
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), true
+}
+
+func (s *cidrSet) Add(str string) bool {
+	p, ok := parseCidrPrefix(str)
+	if !ok {
+		return false
+	}
+	if _, found := s.prefixes[p]; found {
+		return true
+	}
+	s.prefixes[p] = struct{}{}
+
+	bits := &s.bits6
+	if p.Addr().Is4() {
+		bits = &s.bits4
+	}
+	i := sort.SearchInts(*bits, p.Bits())
+	if i == len(*bits) || (*bits)[i] != p.Bits() {
+		*bits = append(*bits, 0)
+		copy((*bits)[i+1:], (*bits)[i:])
+		(*bits)[i] = p.Bits()
+	}
+	return true
+}
+
+func (s *cidrSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.prefixes)
+}
+
+// Check if the whole prefix `p' is within any CIDR in the set
+func (s *cidrSet) Contains(p netip.Prefix) bool {
+	if s == nil {
+		return false
+	}
+	bits := s.bits6
+	if p.Addr().Is4() {
+		bits = s.bits4
+	}
+	for _, n := range bits {
+		if n > p.Bits() {
+			break
+		}
+		if _, found := s.prefixes[netip.PrefixFrom(p.Addr(), n).Masked()]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the IP address is within any CIDR in the set
+func (s *cidrSet) ContainsIP(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return s.Contains(netip.PrefixFrom(addr, addr.BitLen()))
+}
+
+// Return CIDRs in the set, in no particular order
+func (s *cidrSet) Prefixes() []string {
+	var prefixes []string
+	if s != nil {
+		for p := range s.prefixes {
+			prefixes = append(prefixes, p.String())
+		}
+	}
+	return prefixes
+}
+
+// Convert a reverse DNS name to the prefix it stands for
+// e.g. 2.1.10.in-addr.arpa is 10.1.2.0/24, and 0.0.d.f.ip6.arpa is fd00::/16
+// `name' is lower cased and without trailing dot
+func reverseNameToPrefix(name string) (netip.Prefix, bool) {
+	var labels []string
+	ipv4 := false
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels = strings.Split(name[:len(name)-len(".in-addr.arpa")], ".")
+		ipv4 = true
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		labels = strings.Split(name[:len(name)-len(".ip6.arpa")], ".")
+	default:
+		return netip.Prefix{}, false
+	}
+
+	if ipv4 {
+		if len(labels) > net4Labels {
+			return netip.Prefix{}, false
+		}
+		var a [4]byte
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return netip.Prefix{}, false
+			}
+			a[len(labels)-1-i] = byte(n)
+		}
+		return netip.PrefixFrom(netip.AddrFrom4(a), 8*len(labels)), true
+	}
+
+	if len(labels) > net6Labels {
+		return netip.Prefix{}, false
+	}
+	var a [16]byte
+	for i, label := range labels {
+		if len(label) != 1 {
+			return netip.Prefix{}, false
+		}
+		n, err := strconv.ParseUint(label, 16, 8)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		j := len(labels) - 1 - i
+		if j%2 == 0 {
+			a[j/2] |= byte(n) << 4
+		} else {
+			a[j/2] |= byte(n)
+		}
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(a), 4*len(labels)), true
+}
+
+const (
+	// Number of labels of a full reverse DNS name, excluding in-addr.arpa and ip6.arpa
+	net4Labels = 4
+	net6Labels = 32
+)
@@ -0,0 +1,84 @@
+package dnsredir
+
+import (
+	"github.com/coredns/caddy"
+	"strings"
+	"testing"
+)
+
+func TestReverseNameToPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string // Empty if not a reverse DNS name
+	}{
+		{"4.3.2.10.in-addr.arpa", "10.2.3.4/32"},
+		{"2.1.10.in-addr.arpa", "10.1.2.0/24"},
+		{"10.in-addr.arpa", "10.0.0.0/8"},
+		{"5.4.3.2.10.in-addr.arpa", ""},
+		{"256.10.in-addr.arpa", ""},
+		{"x.10.in-addr.arpa", ""},
+		{"in-addr.arpa", ""},
+		{"0.0.d.f.ip6.arpa", "fd00::/16"},
+		{"d.f.ip6.arpa", "fd00::/8"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", "fd00::1/128"},
+		{"00.d.f.ip6.arpa", ""},
+		{"g.f.ip6.arpa", ""},
+		{"example.com", ""},
+	}
+	for i, test := range tests {
+		p, ok := reverseNameToPrefix(test.name)
+		if ok != (len(test.prefix) != 0) || (ok && p.String() != test.prefix) {
+			t.Errorf("Test case#%v failed, %q got %v %v, expected %q", i, test.name, p, ok, test.prefix)
+		}
+	}
+}
+
+func TestCidrMatch(t *testing.T) {
+	const input = `
+dnsredir cidr:10.0.0.0/12 cidr:192.168.1.1 cidr:fd00::/8 {
+	to 1.1.1.1
+	except cidr:10.1.0.0/16
+}
+`
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		matched bool
+	}{
+		{"1.0.0.10.in-addr.arpa", true},
+		{"0.15.10.in-addr.arpa", true},
+		{"16.10.in-addr.arpa", false},
+		// Wider than the CIDR
+		{"10.in-addr.arpa", false},
+		{"2.0.1.10.in-addr.arpa", false},
+		{"1.1.168.192.in-addr.arpa", true},
+		{"2.1.168.192.in-addr.arpa", false},
+		{"1.1.168.192.in-addr.arpa.example.com", false},
+		{"a.b.d.f.ip6.arpa", true},
+		{"d.f.ip6.arpa", true},
+		{"f.ip6.arpa", false},
+		{"e.f.ip6.arpa", false},
+	}
+	for i, test := range tests {
+		if up.Match(test.name) != test.matched {
+			t.Errorf("Test case#%v failed, Match(%q) expected %v", i, test.name, test.matched)
+		}
+	}
+
+	n := &NameList{}
+	res, err := n.parse(strings.NewReader("# comment\n172.16.0.0/12\n::ffff:100.64.0.0/106\n!172.16.1.0/24\nbad\n"), &NameItem{format: nameFormatCidr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.names.Len() != 2 || res.excluded.Len() != 1 || res.invalid != 1 {
+		t.Errorf("Unexpected parse result, names: %v, excluded: %v, invalid: %v", res.names, res.excluded, res.invalid)
+	}
+	if !res.names.Match("1.0.64.100.in-addr.arpa") || !res.excluded.Match("1.1.16.172.in-addr.arpa") {
+		t.Errorf("CIDR of parse result not matched")
+	}
+}
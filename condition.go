@@ -0,0 +1,188 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"errors"
+	"fmt"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Conditions of a block other than the query name, all of them must be satisfied
+// A nil set means unrestricted
+type requestCondition struct {
+	qtype    map[uint16]struct{}
+	notQtype map[uint16]struct{}
+	qclass   map[uint16]struct{}
+	opcode   map[int]struct{}
+
+	// Client source addresses, see: from_client and not_from_client
+	fromClient    []*net.IPNet
+	notFromClient []*net.IPNet
+	// Forwarders whose EDNS client subnet is taken as the client address
+	trustedEcs []*net.IPNet
+}
+
+// Parse `qtype TYPE...', `not_qtype TYPE...', `qclass CLASS...', `opcode OPCODE...',
+// `from_client CIDR...', `not_from_client CIDR...' and `trusted_ecs CIDR...'
+// Multiple lines of the same directive are merged together
+func (rc *requestCondition) parse(dir string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing arguments")
+	}
+	for _, arg := range args {
+		arg = strings.ToUpper(arg)
+		switch dir {
+		case "qtype", "not_qtype":
+			t, ok := dns.StringToType[arg]
+			if !ok {
+				n, err := parseRRNumber(arg, "TYPE")
+				if err != nil {
+					return errors.New(fmt.Sprintf("unknown type %q", arg))
+				}
+				t = n
+			}
+			if dir == "qtype" {
+				rc.qtype = addUint16(rc.qtype, t)
+			} else {
+				rc.notQtype = addUint16(rc.notQtype, t)
+			}
+		case "qclass":
+			c, ok := dns.StringToClass[arg]
+			if !ok {
+				n, err := parseRRNumber(arg, "CLASS")
+				if err != nil {
+					return errors.New(fmt.Sprintf("unknown class %q", arg))
+				}
+				c = n
+			}
+			rc.qclass = addUint16(rc.qclass, c)
+		case "opcode":
+			op, ok := dns.StringToOpcode[arg]
+			if !ok {
+				return errors.New(fmt.Sprintf("unknown opcode %q", arg))
+			}
+			if rc.opcode == nil {
+				rc.opcode = make(map[int]struct{})
+			}
+			rc.opcode[op] = struct{}{}
+		case "from_client", "not_from_client", "trusted_ecs":
+			ipNet, err := parseCIDR(arg)
+			if err != nil {
+				return err
+			}
+			switch dir {
+			case "from_client":
+				rc.fromClient = append(rc.fromClient, ipNet)
+			case "not_from_client":
+				rc.notFromClient = append(rc.notFromClient, ipNet)
+			default:
+				rc.trustedEcs = append(rc.trustedEcs, ipNet)
+			}
+		default:
+			panic(fmt.Sprintf("Unexpected directive %v", dir))
+		}
+	}
+	return nil
+}
+
+// Parse generic form of RR type and class, e.g. TYPE65, CLASS255, see: RFC 3597
+func parseRRNumber(s, prefix string) (uint16, error) {
+	if !strings.HasPrefix(s, prefix) {
+		return 0, errors.New("no prefix")
+	}
+	n, err := strconv.ParseUint(s[len(prefix):], 10, 16)
+	return uint16(n), err
+}
+
+func addUint16(set map[uint16]struct{}, n uint16) map[uint16]struct{} {
+	if set == nil {
+		set = make(map[uint16]struct{})
+	}
+	set[n] = struct{}{}
+	return set
+}
+
+// CIDR or a single IP address
+func parseCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("bad CIDR %q", s))
+	}
+	return ipNet, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the client address, which is the EDNS client subnet address if the request comes from a trusted forwarder
+func (rc *requestCondition) clientIP(state *request.Request) net.IP {
+	ip := net.ParseIP(state.IP())
+	if !containsIP(rc.trustedEcs, ip) {
+		return ip
+	}
+	if opt := state.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok && ecs.SourceNetmask != 0 {
+				return ecs.Address
+			}
+		}
+	}
+	return ip
+}
+
+func (rc *requestCondition) accept(state *request.Request) bool {
+	if rc.opcode != nil {
+		if _, ok := rc.opcode[state.Req.Opcode]; !ok {
+			return false
+		}
+	}
+	if rc.fromClient != nil || rc.notFromClient != nil {
+		ip := rc.clientIP(state)
+		if rc.fromClient != nil && !containsIP(rc.fromClient, ip) {
+			return false
+		}
+		if containsIP(rc.notFromClient, ip) {
+			return false
+		}
+	}
+	if rc.qtype == nil && rc.notQtype == nil && rc.qclass == nil {
+		return true
+	}
+
+	qtype := state.QType()
+	if rc.qtype != nil {
+		if _, ok := rc.qtype[qtype]; !ok {
+			return false
+		}
+	}
+	if _, ok := rc.notQtype[qtype]; ok {
+		return false
+	}
+	if rc.qclass != nil {
+		if _, ok := rc.qclass[state.QClass()]; !ok {
+			return false
+		}
+	}
+	return true
+}
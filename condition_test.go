@@ -0,0 +1,61 @@
+package dnsredir
+
+import (
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestClientConditions(t *testing.T) {
+	rc := &requestCondition{}
+	for _, args := range [][]string{
+		{"from_client", "10.0.0.0/8", "fd00::/8"},
+		{"not_from_client", "10.0.1.1"},
+		{"trusted_ecs", "127.0.0.1"},
+	} {
+		if err := rc.parse(args[0], args[1:]); err != nil {
+			t.Fatalf("parse(%v) failed: %v", args, err)
+		}
+	}
+	if err := rc.parse("from_client", []string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("Expected error for bad CIDR")
+	}
+
+	tests := []struct {
+		remote   string
+		ecs      string // Client subnet, empty if none
+		accepted bool
+	}{
+		{"10.1.2.3", "", true},
+		{"fd00::1", "", true},
+		{"192.168.1.1", "", false},
+		{"10.0.1.1", "", false},
+		// Client subnet from untrusted forwarders is ignored
+		{"10.1.2.3", "192.168.1.0", true},
+		{"192.168.1.1", "10.1.2.0", false},
+		// Client subnet from trusted forwarders
+		{"127.0.0.1", "10.1.2.0", true},
+		{"127.0.0.1", "192.168.1.0", false},
+		{"127.0.0.1", "", false},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if len(test.ecs) != 0 {
+			req.SetEdns0(4096, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       net.ParseIP(test.ecs),
+			})
+		}
+		state := &request.Request{W: &coretest.ResponseWriter{RemoteIP: test.remote}, Req: req}
+		if rc.accept(state) != test.accepted {
+			t.Errorf("Test case#%v failed, expected accepted: %v", i, test.accepted)
+		}
+	}
+}
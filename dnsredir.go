@@ -7,6 +7,7 @@ package dnsredir
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/debug"
 	"github.com/coredns/coredns/plugin/metrics"
@@ -14,6 +15,7 @@ import (
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -24,6 +26,15 @@ type Dnsredir struct {
 	Next plugin.Handler
 
 	Upstreams *[]Upstream
+
+	// Find the most specific match across all blocks, instead of the first matched one
+	longestMatch bool
+	// Index of names across all blocks, rebuilt after any name list changed, see: matchindex.go
+	index         atomic.Pointer[matchIndex]
+	indexGen      atomic.Uint64
+	indexLock     sync.Mutex
+	indexDirty    bool
+	indexBuilding bool
 }
 
 // Upstream manages a pool of proxy upstream hosts
@@ -31,6 +42,11 @@ type Dnsredir struct {
 type Upstream interface {
 	// Check if given domain name should be routed to this upstream zone
 	Match(name string) bool
+	// Check if given name suffix is exactly listed in, or excepted from this upstream zone
+	// `whole' denotes if the suffix is the query name itself, which rules other than suffix rules apply to
+	Lookup(suffix string, whole bool) (listed bool, excepted bool)
+	// Check if conditions other than the query name(e.g. query type) are satisfied by the request
+	Accept(state *request.Request) bool
 	// Select an upstream host to be routed to, nil if no available host
 	Select() *UpstreamHost
 
@@ -49,6 +65,10 @@ func (r *Dnsredir) OnStartup() error {
 			return err
 		}
 	}
+	if r.longestMatch {
+		// In case of name items taken over from previous instance
+		r.buildIndex()
+	}
 	return nil
 }
 
@@ -66,80 +86,295 @@ func (r *Dnsredir) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.
 	name := state.Name()
 
 	server := metrics.WithServer(ctx)
-	upstream0, t := r.match(server, name)
+	upstream0, t := r.match(server, state)
 	if upstream0 == nil {
 		log.Debugf("%q not found in name list, t: %v", name, t)
 		return plugin.NextOrFailure(r.Name(), r.Next, ctx, w, req)
 	}
 	upstream := upstream0.(*reloadableUpstream)
 	log.Debugf("%q in name list, t: %v", name, t)
+	matchName := name
+	if len(matchName) > 1 {
+		matchName = removeTrailingDot(matchName)
+	}
 
-	var reply *dns.Msg
-	var upstreamErr error
-	var tryCount int32
+	var key cacheKey
+	cache := upstream.cacheFor(state)
+	if cache != nil {
+		key = newCacheKey(state)
+		if reply, prefetch := cache.get(state, key, time.Now(), false); reply != nil {
+			CacheRequestCount.WithLabelValues(server, "hit").Inc()
+			if prefetch {
+				go upstream.prefetch(&request.Request{W: w, Req: req.Copy()}, matchName, key)
+			}
+			_ = w.WriteMsg(state.Scrub(reply))
+			return dns.RcodeSuccess, nil
+		}
+		CacheRequestCount.WithLabelValues(server, "miss").Inc()
+	}
+
+	res := upstream.exchangeShared(ctx, state, matchName)
+	RetryCount.WithLabelValues(server).Observe(float64(res.tryCount - 1))
+	if res.err != nil {
+		if cache != nil && cache.serveStale != 0 {
+			if reply, _ := cache.get(state, key, time.Now(), true); reply != nil {
+				log.Debugf("Serve stale reply of %q since exchange failed: %v", name, res.err)
+				CacheRequestCount.WithLabelValues(server, "stale").Inc()
+				_ = w.WriteMsg(state.Scrub(reply))
+				return dns.RcodeSuccess, nil
+			}
+		}
+		return dns.RcodeServerFailure, res.err
+	}
+	host := res.host
+
+	if !state.Match(res.reply) {
+		debug.Hexdumpf(res.reply, "Wrong reply  id: %v, qname: %v qtype: %v", res.reply.Id, state.QName(), state.QType())
+
+		formerr := new(dns.Msg)
+		formerr.SetRcode(state.Req, dns.RcodeFormatError)
+		_ = w.WriteMsg(formerr)
+		return dns.RcodeSuccess, nil
+	}
+
+	reply := upstream.filterReply(state, res)
+	// Add resolved IPs to ipset/pf before write response to DNS resolver
+	// 	thus the rule based routing can take effect immediately
+	ipsetAddIP(upstream, reply)
+	pfAddIP(upstream, reply)
+	if cache != nil {
+		cache.set(key, reply, time.Now())
+	}
+	_ = w.WriteMsg(reply)
+
+	RequestDuration.WithLabelValues(server, host.Name()).Observe(float64(res.duration.Milliseconds()))
+	RequestCount.WithLabelValues(server, host.Name()).Inc()
+
+	rc, ok := dns.RcodeToString[reply.Rcode]
+	if !ok {
+		rc = strconv.Itoa(reply.Rcode)
+	}
+	RcodeCount.WithLabelValues(server, host.Name(), rc).Inc()
+	return dns.RcodeSuccess, nil
+}
+
+// Exchange the request with upstream groups of the block
+// `name' is lower cased and without trailing dot(except for root zone)
+func (u *reloadableUpstream) exchange(ctx context.Context, state *request.Request, name string) *exchangeResult {
 	deadline := time.Now().Add(defaultTimeout)
+	if u.foreign != nil {
+		return exchangeSplit(ctx, state, u, name, deadline)
+	}
+	return exchangeWithRetry(ctx, state, u, u.HealthCheck, func() *UpstreamHost {
+		return u.SelectFor(name)
+	}, deadline)
+}
+
+// Like exchange(), but concurrent identical requests share a single exchange
+// Requests are identical if they have the same question, DO and CD bits, transport and EDNS buffer size
+// Only standard queries are coalesced, others(e.g. UPDATE) have side effects, each of them must reach the upstream
+func (u *reloadableUpstream) exchangeShared(ctx context.Context, state *request.Request, name string) *exchangeResult {
+	if state.Req.Opcode != dns.OpcodeQuery {
+		return u.exchange(ctx, state, name)
+	}
+
+	leader := false
+	v, _, shared := u.inflight.Do(inflightKey(state), func() (interface{}, error) {
+		leader = true
+		// Followers share the exchange, thus it isn't cancelled along with the leader's request
+		// It's still bounded by the deadline of exchange()
+		return u.exchange(context.WithoutCancel(ctx), state, name), nil
+	})
+	res := v.(*exchangeResult)
+	if !shared {
+		return res
+	}
+	if !leader {
+		CoalescedRequestCount.WithLabelValues(u.server).Inc()
+	}
+	if res.err != nil {
+		return res
+	}
+
+	// Every request gets its own copy, with its own ID, question, OPT record and truncation
+	copied := *res
+	copied.reply = res.reply.Copy()
+	copied.reply.Id = state.Req.Id
+	copied.reply.Question = []dns.Question{state.Req.Question[0]}
+	removeOPT(copied.reply)
+	state.SizeAndDo(copied.reply)
+	copied.reply = state.Scrub(copied.reply)
+	return &copied
+}
+
+// Key of in-flight requests, replies depend on the transport and EDNS buffer size, see: UpstreamHost.Exchange()
+func inflightKey(state *request.Request) string {
+	return fmt.Sprintf("%v %v %v %v", state.Proto(), state.Req.IsEdns0() != nil, state.Size(), newCacheKey(state))
+}
+
+// Rewrite the reply to NXDOMAIN if it has addresses in bogus_nxdomain, otherwise return it as is
+func (u *reloadableUpstream) filterReply(state *request.Request, res *exchangeResult) *dns.Msg {
+	reply := res.reply
+	if !u.bogusNxdomain.ContainsAny(reply) {
+		return reply
+	}
+	log.Debugf("Rewrite reply of %q from %v to NXDOMAIN since it has addresses in %v", state.Name(), res.host.Name(), "bogus_nxdomain")
+	BogusReplyCount.WithLabelValues(u.server, res.host.Name(), "nxdomain").Inc()
+	nxdomain := new(dns.Msg)
+	nxdomain.SetRcode(state.Req, dns.RcodeNameError)
+	nxdomain.RecursionAvailable = reply.RecursionAvailable
+	return nxdomain
+}
+
+// Refresh the cached reply of the request in background, see: prefetch
+// `state' must be a copy since the request is already served
+func (u *reloadableUpstream) prefetch(state *request.Request, name string, key cacheKey) {
+	state.Req.Id = dns.Id()
+	res := u.exchange(context.Background(), state, name)
+	if res.err != nil || !state.Match(res.reply) {
+		log.Debugf("Failed to prefetch %q: %v", state.Name(), res.err)
+		u.cache.prefetchFailed(key)
+		return
+	}
+	CachePrefetchCount.WithLabelValues(u.server).Inc()
+	reply := u.filterReply(state, res)
+	ipsetAddIP(u, reply)
+	pfAddIP(u, reply)
+	if !u.cache.set(key, reply, time.Now()) {
+		u.cache.prefetchFailed(key)
+	}
+}
+
+// Result of exchanging a request with an upstream group
+type exchangeResult struct {
+	reply *dns.Msg
+	// Host which the reply comes from
+	host *UpstreamHost
+	// Number of hosts selected
+	tryCount int32
+	// Time the successful exchange took
+	duration time.Duration
+	err      error
+}
+
+// Exchange the request with hosts returned by selectHost(), retry on failure until the deadline
+// Hosts whose replies are rejected by reject_answer_ip are replaced by other hosts of the group(if any)
+func exchangeWithRetry(ctx context.Context, state *request.Request, upstream *reloadableUpstream, group *HealthCheck, selectHost func() *UpstreamHost, deadline time.Time) *exchangeResult {
+	res := &exchangeResult{}
+	var rejected map[*UpstreamHost]struct{}
 	for time.Now().Before(deadline) {
 		start := time.Now()
 
-		tryCount++
-		host := upstream.Select()
-		if host == nil || tryCount > upstream.maxRetry {
+		res.tryCount++
+		host := selectHost()
+		if host == nil || res.tryCount > upstream.maxRetry {
 			log.Debug(errNoHealthy)
-			return dns.RcodeServerFailure, errNoHealthy
+			res.err = errNoHealthy
+			return res
+		}
+		if _, found := rejected[host]; found {
+			if other := group.selectExcept(rejected); other != nil {
+				host = other
+			}
 		}
 		log.Debugf("Upstream host %v is selected", host.Name())
 
+		var reply *dns.Msg
+		var err error
 		for {
 			t := time.Now()
-			reply, upstreamErr = host.Exchange(ctx, state, upstream.bootstrap, upstream.noIPv6)
+			reply, err = host.Exchange(ctx, state, upstream.bootstrap, upstream.noIPv6)
 			log.Debugf("rtt: %v", time.Since(t))
-			if upstreamErr == errCachedConnClosed {
+			if err == errCachedConnClosed {
 				// [sic] Remote side closed conn, can only happen with TCP.
 				// Retry for another connection
-				log.Debugf("%v: %v", upstreamErr, host.Name())
+				log.Debugf("%v: %v", err, host.Name())
 				continue
 			}
 			break
 		}
 
-		if upstreamErr != nil {
+		if err != nil {
+			res.err = err
 			if upstream.maxFails != 0 {
-				log.Warningf("Exchange() failed  error: %v", upstreamErr)
+				log.Warningf("Exchange() failed  error: %v", err)
 				healthCheck(upstream, host)
 			}
 			continue
 		}
 
-		if !state.Match(reply) {
-			debug.Hexdumpf(reply, "Wrong reply  id: %v, qname: %v qtype: %v", reply.Id, state.QName(), state.QType())
-
-			formerr := new(dns.Msg)
-			formerr.SetRcode(state.Req, dns.RcodeFormatError)
-			_ = w.WriteMsg(formerr)
-			return dns.RcodeSuccess, nil
+		if upstream.rejectAnswerIP.ContainsAny(reply) {
+			log.Debugf("Reject reply of %q from %v since it has addresses in %v", state.Name(), host.Name(), "reject_answer_ip")
+			BogusReplyCount.WithLabelValues(upstream.server, host.Name(), "reject").Inc()
+			if rejected == nil {
+				rejected = make(map[*UpstreamHost]struct{})
+			}
+			rejected[host] = struct{}{}
+			res.err = errRejectedReply
+			continue
 		}
 
-		// Add resolved IPs to ipset/pf before write response to DNS resolver
-		// 	thus the rule based routing can take effect immediately
-		ipsetAddIP(upstream, reply)
-		pfAddIP(upstream, reply)
-		_ = w.WriteMsg(reply)
+		res.reply = reply
+		res.host = host
+		res.duration = time.Since(start)
+		res.err = nil
+		return res
+	}
 
-		RequestDuration.WithLabelValues(server, host.Name()).Observe(float64(time.Since(start).Milliseconds()))
-		RequestCount.WithLabelValues(server, host.Name()).Inc()
+	if res.err == nil {
+		panic("Why upstreamErr is nil?! Are you in a debugger or your machine running slow?")
+	}
+	return res
+}
 
-		rc, ok := dns.RcodeToString[reply.Rcode]
-		if !ok {
-			rc = strconv.Itoa(reply.Rcode)
+// Query `to TO...'(i.e. the domestic group) and `foreign TO...' at the same time
+// The domestic reply is taken unless any of its A/AAAA addresses is out of domestic_ip,
+// which is either poisoned or out-of-region, the foreign reply is taken instead
+// The domestic reply is still taken if the foreign group failed
+func exchangeSplit(ctx context.Context, state *request.Request, upstream *reloadableUpstream, name string, deadline time.Time) *exchangeResult {
+	// DoH exchange alters the request message temporarily, thus the foreign group works on a copy
+	foreignState := &request.Request{W: state.W, Req: state.Req.Copy()}
+	ch := make(chan *exchangeResult, 1)
+	go func() {
+		ch <- exchangeWithRetry(ctx, foreignState, upstream, upstream.foreign, upstream.foreign.Select, deadline)
+	}()
+
+	res := exchangeWithRetry(ctx, state, upstream, upstream.HealthCheck, func() *UpstreamHost {
+		return upstream.SelectFor(name)
+	}, deadline)
+	if res.err == nil {
+		if upstream.isDomesticReply(res.reply) {
+			ReplyGroupCount.WithLabelValues(upstream.server, "domestic").Inc()
+			return res
 		}
-		RcodeCount.WithLabelValues(server, host.Name(), rc).Inc()
-		return dns.RcodeSuccess, nil
+		log.Debugf("Discard reply of %q from %v since it has non-domestic addresses", state.Name(), res.host.Name())
+	} else {
+		log.Debugf("Domestic exchange of %q failed: %v", state.Name(), res.err)
 	}
 
-	if upstreamErr == nil {
-		panic("Why upstreamErr is nil?! Are you in a debugger or your machine running slow?")
+	foreignRes := <-ch
+	if foreignRes.err == nil {
+		ReplyGroupCount.WithLabelValues(upstream.server, "foreign").Inc()
+		return foreignRes
+	}
+	if res.err == nil {
+		// A non-domestic reply is better than SERVFAIL
+		log.Debugf("Foreign exchange of %q failed: %v, fallback to reply from %v", state.Name(), foreignRes.err, res.host.Name())
+		ReplyGroupCount.WithLabelValues(upstream.server, "domestic").Inc()
+		return res
 	}
-	return dns.RcodeServerFailure, upstreamErr
+	return foreignRes
+}
+
+// Check if every A/AAAA address in the answer section is within domestic_ip
+// Replies without such addresses(e.g. NXDOMAIN) are taken as domestic
+func (u *reloadableUpstream) isDomesticReply(reply *dns.Msg) bool {
+	for _, addr := range answerIPs(reply) {
+		if !u.domesticIP.Contains(addr) {
+			return false
+		}
+	}
+	return true
 }
 
 func healthCheck(r *reloadableUpstream, uh *UpstreamHost) {
@@ -150,10 +385,12 @@ func healthCheck(r *reloadableUpstream, uh *UpstreamHost) {
 
 	failTimeout := defaultFailTimeout
 	fails := atomic.AddInt32(&uh.fails, 1)
+	uh.updateStateMetrics()
 	go func(uh *UpstreamHost) {
 		time.Sleep(failTimeout)
 		// Failure count may go negative here, should be rectified by HC eventually
 		atomic.AddInt32(&uh.fails, -1)
+		uh.updateStateMetrics()
 		// Kick off health check on every failureCheck failure
 		if fails%failureCheck == 0 {
 			_ = uh.Check()
@@ -163,7 +400,7 @@ func healthCheck(r *reloadableUpstream, uh *UpstreamHost) {
 
 func (r *Dnsredir) Name() string { return pluginName }
 
-func (r *Dnsredir) match(server, name string) (Upstream, time.Duration) {
+func (r *Dnsredir) match(server string, state *request.Request) (Upstream, time.Duration) {
 	t1 := time.Now()
 
 	if r.Upstreams == nil {
@@ -171,28 +408,38 @@ func (r *Dnsredir) match(server, name string) (Upstream, time.Duration) {
 	}
 
 	// Don't check validity of domain name, delegate to upstream host
+	name := state.Name()
 	if len(name) > 1 {
 		name = removeTrailingDot(name)
 	}
 
-	for _, up := range *r.Upstreams {
-		// For maximum performance, we search the first matched item and return directly
-		// Unlike proxy plugin, which try to find longest match
-		if up.Match(name) {
-			t2 := time.Since(t1)
-			NameLookupDuration.WithLabelValues(server, "1").Observe(float64(t2.Milliseconds()))
-			return up, t2
+	var matched Upstream
+	if r.longestMatch {
+		matched = r.longestMatchUpstream(state, name)
+	} else {
+		for _, up := range *r.Upstreams {
+			// For maximum performance, we search the first matched item and return directly
+			if up.Accept(state) && up.Match(name) {
+				matched = up
+				break
+			}
 		}
 	}
 
 	t2 := time.Since(t1)
-	NameLookupDuration.WithLabelValues(server, "0").Observe(float64(t2.Milliseconds()))
-	return nil, t2
+	if matched == nil {
+		NameLookupDuration.WithLabelValues(server, "0").Observe(float64(t2.Milliseconds()))
+		return nil, t2
+	}
+	NameLookupDuration.WithLabelValues(server, "1").Observe(float64(t2.Milliseconds()))
+	BlockMatchCount.WithLabelValues(server, matched.(*reloadableUpstream).key).Inc()
+	return matched, t2
 }
 
 var (
 	errNoHealthy        = errors.New("no healthy upstream host")
 	errCachedConnClosed = errors.New("cached connection was closed by peer")
+	errRejectedReply    = errors.New("reply rejected by reject_answer_ip")
 )
 
 const (
@@ -0,0 +1,493 @@
+package dnsredir
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestRequest(name string, qtype uint16) *request.Request {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	return &request.Request{Req: req}
+}
+
+func TestLongestMatch(t *testing.T) {
+	const input = `
+dnsredir . {
+	to 1.1.1.1
+	except foo.example.com
+}
+dnsredir nonexist1.conf {
+	to 2.2.2.2
+	example.com
+	except sub.example.com
+	longest_match
+}
+dnsredir nonexist2.conf {
+	to 3.3.3.3
+	www.example.com
+	a.foo.example.com
+}
+dnsredir nonexist3.conf {
+	to 4.4.4.4
+	keyword:tracker
+}
+`
+	c := caddy.NewTestController("dns", input)
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatalf("NewReloadableUpstreams() failed: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		longestMatch int
+		firstMatch   int
+	}{
+		{"www.example.com", 2, 0},
+		{"x.www.example.com", 2, 0},
+		{"example.com", 1, 0},
+		{"a.example.com", 1, 0},
+		{"foo.example.com", 1, 1},
+		{"a.foo.example.com", 2, 1},
+		{"sub.example.com", 0, 0},
+		{"x.sub.example.com", 0, 0},
+		{"example.org", 0, 0},
+		{"tracker.example.com", 3, 0},
+		{"tracker.sub.example.com", 3, 0},
+		{".", 0, 0},
+	}
+	for _, longestMatch := range []bool{true, false} {
+		r := &Dnsredir{Upstreams: &ups, longestMatch: longestMatch}
+		for i, test := range tests {
+			up, _ := r.match("", newTestRequest(test.name, dns.TypeA))
+			expected := ups[test.firstMatch]
+			if longestMatch {
+				expected = ups[test.longestMatch]
+			}
+			if up != expected {
+				t.Errorf("Test case#%v failed, longest match: %v, %q matched %v, expected: %v",
+					i, longestMatch, test.name, up.(*reloadableUpstream).from, expected.(*reloadableUpstream).from)
+			}
+		}
+	}
+}
+
+func TestMatchIndexUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.conf")
+	if err := os.WriteFile(path, []byte("example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input := fmt.Sprintf(`
+dnsredir . {
+	to 1.1.1.1
+	longest_match
+}
+dnsredir %v {
+	to 2.2.2.2
+	path_reload 0
+}
+`, path)
+	c := caddy.NewTestController("dns", input)
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatalf("NewReloadableUpstreams() failed: %v", err)
+	}
+	r := &Dnsredir{Upstreams: &ups, longestMatch: true}
+	list := ups[1].(*reloadableUpstream).NameList
+	list.onUpdate = chainUpdate(list.onUpdate, r.blockUpdated(ups[1].(*reloadableUpstream)))
+
+	// Index built before the list is loaded
+	if up, _ := r.match("", newTestRequest("www.example.com", dns.TypeA)); up != ups[0] {
+		t.Fatalf("Expected fallback block before the list is loaded")
+	}
+	// Changed blocks are probed until the index is rebuilt
+	list.updateList(NameItemTypePath, nil)
+	if up, _ := r.match("", newTestRequest("www.example.com", dns.TypeA)); up != ups[1] {
+		t.Fatalf("Name added to the list isn't matched")
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(r.matchIndex().changedBlocks(r)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Index isn't rebuilt after the list updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if up, _ := r.match("", newTestRequest("www.example.com", dns.TypeA)); up != ups[1] {
+		t.Errorf("Name added to the list isn't indexed")
+	}
+}
+
+func BenchmarkLongestMatch(b *testing.B) {
+	dir := b.TempDir()
+	var sb strings.Builder
+	for i := 0; i < 32; i++ {
+		var list strings.Builder
+		for j := 0; j < 1000; j++ {
+			fmt.Fprintf(&list, "d%v-%v.example.com\n", i, j)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("list%v.conf", i))
+		if err := os.WriteFile(path, []byte(list.String()), 0644); err != nil {
+			b.Fatal(err)
+		}
+		fmt.Fprintf(&sb, "dnsredir %v {\n to 1.1.1.1\n longest_match\n}\n", path)
+	}
+	c := caddy.NewTestController("dns", sb.String())
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		b.Fatalf("NewReloadableUpstreams() failed: %v", err)
+	}
+	for _, up := range ups {
+		up.(*reloadableUpstream).updateList(NameItemTypePath, nil)
+	}
+	r := &Dnsredir{Upstreams: &ups, longestMatch: true}
+	state := newTestRequest("a.b.c.d31-999.example.com", dns.TypeA)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if up, _ := r.match("", state); up != ups[31] {
+			b.Fatalf("Unexpected match")
+		}
+	}
+}
+
+func TestMatchConditions(t *testing.T) {
+	const input = `
+dnsredir nonexist1.conf {
+	to 1.1.1.1
+	example.com
+	qtype AAAA https
+}
+dnsredir nonexist2.conf {
+	to 2.2.2.2
+	example.com
+	opcode UPDATE NOTIFY
+}
+dnsredir nonexist3.conf {
+	to 3.3.3.3
+	example.com
+	not_qtype PTR
+	qclass IN
+}
+dnsredir . {
+	to 4.4.4.4
+	opcode QUERY
+}
+`
+	c := caddy.NewTestController("dns", input)
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatalf("NewReloadableUpstreams() failed: %v", err)
+	}
+
+	tests := []struct {
+		qtype   uint16
+		qclass  uint16
+		opcode  int
+		matched int // -1 if none
+	}{
+		{dns.TypeAAAA, dns.ClassINET, dns.OpcodeQuery, 0},
+		{dns.TypeHTTPS, dns.ClassINET, dns.OpcodeQuery, 0},
+		{dns.TypeA, dns.ClassINET, dns.OpcodeQuery, 2},
+		{dns.TypePTR, dns.ClassINET, dns.OpcodeQuery, 3},
+		{dns.TypeTXT, dns.ClassCHAOS, dns.OpcodeQuery, 3},
+		{dns.TypeSOA, dns.ClassINET, dns.OpcodeUpdate, 1},
+		{dns.TypePTR, dns.ClassINET, dns.OpcodeStatus, -1},
+	}
+	for _, longestMatch := range []bool{true, false} {
+		r := &Dnsredir{Upstreams: &ups, longestMatch: longestMatch}
+		for i, test := range tests {
+			state := newTestRequest("www.example.com", test.qtype)
+			state.Req.Question[0].Qclass = test.qclass
+			state.Req.Opcode = test.opcode
+			up, _ := r.match("", state)
+			var expected Upstream
+			if test.matched >= 0 {
+				expected = ups[test.matched]
+			}
+			if up != expected {
+				t.Errorf("Test case#%v failed, longest match: %v, matched %v, expected %v", i, longestMatch, up, expected)
+			}
+		}
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n to 1.1.1.1\n qtype\n}",
+		"dnsredir . {\n to 1.1.1.1\n qtype NONEXIST\n}",
+		"dnsredir . {\n to 1.1.1.1\n qclass TYPE1\n}",
+		"dnsredir . {\n to 1.1.1.1\n opcode TYPE1\n}",
+	} {
+		if _, err := NewReloadableUpstreams(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestDomesticReply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domestic.txt")
+	if err := os.WriteFile(path, []byte("114.114.0.0/16\n!114.114.114.0/24\n240e::/20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input := fmt.Sprintf(`
+dnsredir . {
+	to 114.114.114.114
+	foreign 8.8.8.8 tls://1.1.1.1
+	domestic_ip 223.5.5.0/24 %v
+}
+`, path)
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed: %v", err)
+	}
+	u := up.(*reloadableUpstream)
+	if len(u.hosts) != 1 || u.foreign == nil || len(u.foreign.hosts) != 2 {
+		t.Fatalf("Unexpected upstream groups, to: %v, foreign: %v", u.hosts, u.foreign)
+	}
+	u.domesticIP.list.updateList(NameItemTypePath, nil)
+
+	tests := []struct {
+		answer   []string
+		domestic bool
+	}{
+		{nil, true},
+		{[]string{"example.com. 60 IN CNAME example.net."}, true},
+		{[]string{"example.com. 60 IN A 223.5.5.5"}, true},
+		{[]string{"example.com. 60 IN A 114.114.1.1", "example.com. 60 IN AAAA 240e::1"}, true},
+		{[]string{"example.com. 60 IN A 223.5.5.5", "example.com. 60 IN A 8.8.8.8"}, false},
+		{[]string{"example.com. 60 IN A 114.114.114.1"}, false},
+		{[]string{"example.com. 60 IN AAAA 2001:db8::1"}, false},
+	}
+	for i, test := range tests {
+		if u.isDomesticReply(newTestReply(t, test.answer...)) != test.domestic {
+			t.Errorf("Test case#%v failed, expected domestic: %v", i, test.domestic)
+		}
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n to 1.1.1.1\n foreign 8.8.8.8\n}",
+		"dnsredir . {\n to 1.1.1.1\n domestic_ip 10.0.0.0/8\n}",
+		"dnsredir . {\n to 1.1.1.1\n foreign 8.8.8.8\n domestic_ip 10.0.0.0/33\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestForeignFailure(t *testing.T) {
+	domestic := startTestServer(t, "93.184.216.34")
+	foreign := startTestServer(t, "93.184.216.34")
+	atomic.StoreInt32(&foreign.drop, 1)
+	input := fmt.Sprintf(`
+dnsredir . {
+	to %v
+	foreign %v
+	domestic_ip 223.5.5.0/24
+	health_check 0
+}
+`, domestic.addr, foreign.addr)
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed: %v", err)
+	}
+	u := up.(*reloadableUpstream)
+	u.HealthCheck.Start()
+	defer u.HealthCheck.Stop()
+	u.foreign.Start()
+	defer u.foreign.Stop()
+
+	state := newTestRequest("example.com", dns.TypeA)
+	state.W = &coretest.ResponseWriter{}
+	// Non-domestic reply is taken since the foreign group failed
+	res := exchangeSplit(context.Background(), state, u, "example.com", time.Now().Add(time.Second))
+	if res.err != nil {
+		t.Fatalf("exchangeSplit() failed: %v", res.err)
+	}
+	if res.host.addr != domestic.addr {
+		t.Errorf("Expected reply from %v, got %v", domestic.addr, res.host.addr)
+	}
+
+	// Domestic group failed as well
+	atomic.StoreInt32(&domestic.drop, 1)
+	res = exchangeSplit(context.Background(), state, u, "example.com", time.Now().Add(time.Second))
+	if res.err == nil {
+		t.Errorf("Expected error since both groups failed")
+	}
+}
+
+func TestCoalesceCancelledLeader(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := new(dns.Msg)
+		if err == nil {
+			err = req.Unpack(b)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("93.184.216.34"),
+		})
+		b, _ = m.Pack()
+		w.Header().Set("Content-Type", mimeTypeDnsMessage)
+		_, _ = w.Write(b)
+	}))
+	defer server.Close()
+
+	addr := strings.TrimPrefix(server.URL, "https://")
+	c := caddy.NewTestController("dns", fmt.Sprintf("dnsredir . {\n to ietf-doh://%v/dns-query\n health_check 0\n}", addr))
+	c.Next()
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed: %v", err)
+	}
+	u := up.(*reloadableUpstream)
+	u.hosts[0].httpClient = server.Client()
+	u.HealthCheck.Start()
+	defer u.HealthCheck.Stop()
+
+	// The leader's request is cancelled while the exchange is in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		state := newTestRequest("example.com", dns.TypeA)
+		state.W = &coretest.ResponseWriter{}
+		u.exchangeShared(ctx, state, "example.com")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	state := newTestRequest("example.com", dns.TypeA)
+	state.W = &coretest.ResponseWriter{}
+	res := u.exchangeShared(context.Background(), state, "example.com")
+	if res.err != nil || len(res.reply.Answer) != 1 {
+		t.Errorf("Follower failed along with the leader, err: %v", res.err)
+	}
+}
+
+func TestCoalesceRequests(t *testing.T) {
+	ts := startTestServer(t, "93.184.216.34")
+	atomic.StoreInt64(&ts.delay, int64(300*time.Millisecond))
+	c := caddy.NewTestController("dns", fmt.Sprintf("dnsredir . {\n to %v\n health_check 0\n}", ts.addr))
+	c.Next()
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed: %v", err)
+	}
+	up.(*reloadableUpstream).HealthCheck.Start()
+	defer up.(*reloadableUpstream).HealthCheck.Stop()
+	r := &Dnsredir{Upstreams: &[]Upstream{up}}
+
+	const n = 20
+	var wg sync.WaitGroup
+	replies := make([]*dns.Msg, n)
+	reqs := make([]*dns.Msg, n)
+	for i := 0; i < n; i++ {
+		reqs[i] = new(dns.Msg)
+		// Case of the question is kept per request
+		name := "example.com."
+		if i%2 == 1 {
+			name = "EXAMPLE.com."
+		}
+		reqs[i].SetQuestion(name, dns.TypeA)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+			if _, err := r.ServeDNS(context.Background(), rec, reqs[i]); err != nil {
+				t.Errorf("ServeDNS() failed: %v", err)
+			}
+			replies[i] = rec.Msg
+		}(i)
+	}
+	wg.Wait()
+
+	if q := atomic.LoadInt32(&ts.queries); q != 1 {
+		t.Errorf("Expected 1 upstream query, got %v", q)
+	}
+	for i, reply := range replies {
+		if reply == nil || reply.Id != reqs[i].Id || reply.Question[0].Name != reqs[i].Question[0].Name || len(reply.Answer) != 1 {
+			t.Errorf("Unexpected reply#%v: %v", i, reply)
+		}
+	}
+
+	// Requests with different DO bits aren't identical
+	for _, do := range []bool{false, true} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(4096, do)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = r.ServeDNS(context.Background(), dnstest.NewRecorder(&coretest.ResponseWriter{}), req)
+		}()
+	}
+	wg.Wait()
+	if q := atomic.LoadInt32(&ts.queries); q != 3 {
+		t.Errorf("Expected 3 upstream queries, got %v", q)
+	}
+
+	// Neither are requests with different transports or EDNS buffer sizes, nor non-QUERY opcodes
+	tests := []struct {
+		tcp     bool
+		bufsize uint16 // Zero if no EDNS
+		opcode  int
+	}{
+		{false, 0, dns.OpcodeQuery},
+		{true, 0, dns.OpcodeQuery},
+		{false, 1232, dns.OpcodeQuery},
+		{false, 4096, dns.OpcodeQuery},
+		{false, 0, dns.OpcodeUpdate},
+		{false, 0, dns.OpcodeUpdate},
+	}
+	replies = make([]*dns.Msg, len(tests))
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.Opcode = test.opcode
+		if test.bufsize != 0 {
+			req.SetEdns0(test.bufsize, false)
+		}
+		wg.Add(1)
+		go func(i int, tcp bool) {
+			defer wg.Done()
+			rec := dnstest.NewRecorder(&coretest.ResponseWriter{TCP: tcp})
+			_, _ = r.ServeDNS(context.Background(), rec, req)
+			replies[i] = rec.Msg
+		}(i, test.tcp)
+	}
+	wg.Wait()
+	if q := atomic.LoadInt32(&ts.queries); q != 3+int32(len(tests)) {
+		t.Errorf("Expected %v upstream queries, got %v", 3+len(tests), q)
+	}
+	for i, test := range tests {
+		if replies[i] == nil || (replies[i].IsEdns0() != nil) != (test.bufsize != 0) {
+			t.Errorf("Unexpected reply#%v: %v", i, replies[i])
+		}
+	}
+}
@@ -0,0 +1,438 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Name list formats, which can be tagged on FROM item, e.g. abp+https://example.com/list.txt
+const (
+	// Plain domain, dnsmasq server=/DOMAIN/..., hosts and Adblock Plus rules are detected line by line
+	nameFormatAuto = "auto"
+	// IP NAME [ALIAS...]
+	nameFormatHosts = "hosts"
+	// Adblock Plus / uBlock network rules, i.e. ||DOMAIN^ and @@||DOMAIN^
+	nameFormatAbp = "abp"
+	// Base64 encoded Adblock Plus rules, see: https://github.com/gfwlist/gfwlist
+	nameFormatGfwlist = "gfwlist"
+	// Clash rule provider, either YAML(payload:) or text, with domain or classical behavior
+	nameFormatClash = "clash"
+	// Surge rule set(DOMAIN-SUFFIX,DOMAIN) or domain set
+	nameFormatSurge = "surge"
+	// v2ray geosite.dat, a category must be selected, e.g. geosite.dat:cn
+	nameFormatGeosite = "geosite"
+	// Precompiled binary snapshot, see: snapshot.go
+	nameFormatSnapshot = "snapshot"
+	// CIDR or IP address per line, matches reverse DNS names within them
+	nameFormatCidr = "cidr"
+)
+
+var knownFormats = []string{
+	nameFormatAuto,
+	nameFormatHosts,
+	nameFormatAbp,
+	nameFormatGfwlist,
+	nameFormatClash,
+	nameFormatSurge,
+	nameFormatGeosite,
+	nameFormatSnapshot,
+	nameFormatCidr,
+}
+
+// Split FROM item into format tag and path/URL
+// nameFormatAuto is returned if there's no format tag
+func splitFormat(from string) (string, string) {
+	if i := strings.IndexByte(from, '+'); i > 0 {
+		tag := strings.ToLower(from[:i])
+		for _, format := range knownFormats {
+			if tag == format {
+				return format, from[i+1:]
+			}
+		}
+	}
+	return nameFormatAuto, from
+}
+
+// Split geosite category selector from path/URL, e.g. geosite.dat:cn
+// Untagged .dat files are taken as geosite, and untagged .yaml/.yml files are taken as Clash rule provider
+// Return format, path/URL and the category
+func splitCategory(format, from string) (string, string, string) {
+	base := from[strings.LastIndexByte(from, '/')+1:]
+	if format == nameFormatGeosite || (format == nameFormatAuto && strings.Contains(strings.ToLower(base), ".dat:")) {
+		if i := strings.LastIndexByte(base, ':'); i > 0 {
+			return nameFormatGeosite, from[:len(from)-len(base)+i], base[i+1:]
+		}
+		return nameFormatGeosite, from, ""
+	}
+
+	if format == nameFormatAuto {
+		base, _ = SplitByByte(base, '?')
+		switch strings.ToLower(path.Ext(base)) {
+		case ".yaml", ".yml":
+			return nameFormatClash, from, ""
+		}
+	}
+	return format, from, ""
+}
+
+// Base64 encoded "[AutoProxy", which is the header line of gfwlist
+var gfwlistMagic = []byte("W0F1dG9Qcm94eS")
+
+func isGfwlist(br *bufio.Reader) bool {
+	b, _ := br.Peek(len(gfwlistMagic))
+	return bytes.Equal(b, gfwlistMagic)
+}
+
+// Names in hosts file which should never be redirected
+var hostsIgnoredNames = StringSet{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// Format: IP NAME [ALIAS...]
+func parseHostsLine(line string, res *parseResult) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	f := strings.Fields(line)
+	if len(f) < 2 || net.ParseIP(f[0]) == nil {
+		return
+	}
+	for _, name := range f[1:] {
+		if hostsIgnoredNames.Contains(strings.ToLower(name)) {
+			continue
+		}
+		if !res.names.Add(name) {
+			res.invalid++
+		}
+	}
+}
+
+// Only rules which block(or unblock) a whole domain are honored, i.e.
+//
+//	||DOMAIN^, ||DOMAIN, |http://DOMAIN/..., .DOMAIN, DOMAIN
+//	@@ prefixed rules of above are exceptions
+//
+// Comments, element hiding rules, regex rules, rules with path or with options are ignored
+// see: https://help.eyeo.com/adblockplus/how-to-write-filters
+func parseAbpLine(line string, res *parseResult) {
+	if len(line) == 0 || line[0] == '!' || line[0] == '[' {
+		return
+	}
+	if strings.Contains(line, "#") {
+		// Element hiding rules
+		return
+	}
+
+	names := res.names
+	if strings.HasPrefix(line, "@@") {
+		line = line[2:]
+		names = res.excluded
+	}
+
+	if i := strings.IndexByte(line, '$'); i >= 0 {
+		// Options which don't narrow down the rule are harmless
+		switch line[i+1:] {
+		case "important", "all", "document":
+			line = line[:i]
+		default:
+			return
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(line, "||"):
+		line = strings.TrimSuffix(line[2:], "^")
+		line = strings.TrimSuffix(line, "/")
+	case strings.HasPrefix(line, "|"):
+		u, err := url.Parse(line[1:])
+		if err != nil || len(u.Hostname()) == 0 || (u.Path != "" && u.Path != "/") {
+			return
+		}
+		line = u.Hostname()
+	case strings.HasPrefix(line, "/"):
+		// Regex rules
+		return
+	default:
+		line = strings.TrimPrefix(line, ".")
+	}
+
+	if strings.ContainsAny(line, "/^*|:") {
+		// Wildcard rules, rules with path, etc.
+		return
+	}
+	if !names.Add(line) {
+		res.invalid++
+	}
+}
+
+// Clash rule provider line, YAML list item prefix and quotes are stripped
+//
+//	payload:
+//	  - '+.example.com'
+//	  - 'DOMAIN-SUFFIX,example.org'
+//
+// see: https://wiki.metacubex.one/en/config/rule-providers/content/
+func parseClashLine(line string, res *parseResult) {
+	if line == "payload:" || strings.HasPrefix(line, "#") {
+		return
+	}
+	if i := strings.Index(line, " #"); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(strings.TrimPrefix(line, "-"))
+	line = strings.Trim(line, `'"`)
+	if len(line) == 0 {
+		return
+	}
+	if strings.IndexByte(line, ',') > 0 {
+		parseRuleLine(line, res)
+		return
+	}
+
+	var ok bool
+	switch {
+	case strings.HasPrefix(line, "+."):
+		ok = res.names.addSuffix(line[2:])
+	case strings.HasPrefix(line, "."):
+		// Subdomains only, approximated by suffix match
+		ok = res.names.addSuffix(line[1:])
+	case strings.ContainsAny(line, "*?"):
+		ok = res.names.addGlob(line)
+	default:
+		ok = res.names.addFull(line)
+	}
+	if !ok {
+		res.invalid++
+	}
+}
+
+// Surge rule set or domain set line
+// see: https://manual.nssurge.com/rule/ruleset.html
+func parseSurgeLine(line string, res *parseResult) {
+	if len(line) == 0 || line[0] == '#' || line[0] == ';' || strings.HasPrefix(line, "//") {
+		return
+	}
+	if strings.IndexByte(line, ',') > 0 {
+		parseRuleLine(line, res)
+		return
+	}
+	// Domain set, leading dot denotes the domain and all its subdomains
+	var ok bool
+	if strings.HasPrefix(line, ".") {
+		ok = res.names.addSuffix(line[1:])
+	} else {
+		ok = res.names.addFull(line)
+	}
+	if !ok {
+		res.invalid++
+	}
+}
+
+// Classical rules shared by Clash and Surge, i.e. TYPE,VALUE[,POLICY...]
+// Rules other than domain rules are ignored
+func parseRuleLine(line string, res *parseResult) {
+	f := strings.Split(line, ",")
+	if len(f) < 2 {
+		return
+	}
+	value := strings.TrimSpace(f[1])
+	var ok bool
+	switch strings.ToUpper(strings.TrimSpace(f[0])) {
+	case "DOMAIN-SUFFIX":
+		ok = res.names.addSuffix(value)
+	case "DOMAIN":
+		ok = res.names.addFull(value)
+	case "DOMAIN-KEYWORD":
+		ok = res.names.addKeyword(value)
+	case "DOMAIN-REGEX":
+		ok = res.names.addRegexp(value)
+	case "DOMAIN-WILDCARD":
+		ok = res.names.addGlob(value)
+	default:
+		return
+	}
+	if !ok {
+		res.invalid++
+	}
+}
+
+// v2ray geosite.dat is a protobuf encoded GeoSiteList
+//
+//	message Domain {
+//	  enum Type { Plain = 0; Regex = 1; Domain = 2; Full = 3; }
+//	  Type type = 1;
+//	  string value = 2;
+//	  repeated Attribute attribute = 3;
+//	}
+//	message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+//	message GeoSiteList { repeated GeoSite entry = 1; }
+//
+// see: https://github.com/v2fly/v2ray-core/blob/master/app/router/routercommon/common.proto
+const (
+	geositeTypePlain  = 0 // Keyword
+	geositeTypeRegex  = 1
+	geositeTypeDomain = 2 // Suffix
+	geositeTypeFull   = 3
+)
+
+// Iterate over varint and length-delimited fields of a protobuf message
+// for loop will exit in advance if f() return error
+func forEachProtoField(b []byte, f func(num protowire.Number, v uint64, bytes []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v uint64
+		var bytes []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ == protowire.VarintType || typ == protowire.BytesType {
+			if err := f(num, v, bytes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Category is case-insensitive, an attribute can be selected as well, e.g. cn@ads
+func parseGeosite(data []byte, category string, res *parseResult) error {
+	category, attr := SplitByByte(category, '@')
+	attr = strings.TrimPrefix(attr, "@")
+
+	found := false
+	err := forEachProtoField(data, func(num protowire.Number, _ uint64, site []byte) error {
+		if num != 1 || found {
+			return nil
+		}
+
+		var code string
+		var domains [][]byte
+		err := forEachProtoField(site, func(num protowire.Number, _ uint64, b []byte) error {
+			switch num {
+			case 1:
+				code = string(b)
+			case 2:
+				domains = append(domains, b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(code, category) {
+			return nil
+		}
+
+		found = true
+		for _, domain := range domains {
+			if err := parseGeositeDomain(domain, attr, res); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("geosite category %q not found", category))
+	}
+	return nil
+}
+
+func parseGeositeDomain(b []byte, attr string, res *parseResult) error {
+	var typ uint64
+	var value string
+	hasAttr := len(attr) == 0
+	err := forEachProtoField(b, func(num protowire.Number, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			typ = v
+		case 2:
+			value = string(b)
+		case 3:
+			return forEachProtoField(b, func(num protowire.Number, _ uint64, key []byte) error {
+				if num == 1 && strings.EqualFold(string(key), attr) {
+					hasAttr = true
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || !hasAttr {
+		return err
+	}
+
+	res.totalLines++
+	var ok bool
+	switch typ {
+	case geositeTypePlain:
+		ok = res.names.addKeyword(value)
+	case geositeTypeRegex:
+		ok = res.names.addRegexp(value)
+	case geositeTypeDomain:
+		ok = res.names.addSuffix(value)
+	case geositeTypeFull:
+		ok = res.names.addFull(value)
+	}
+	if !ok {
+		res.invalid++
+	}
+	return nil
+}
+
+// Format: CIDR or IP, !CIDR excludes reverse DNS names within CIDR from the whole name list
+func parseCidrLine(line string, res *parseResult) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if len(line) == 0 {
+		return
+	}
+	set := res.names
+	if line[0] == '!' {
+		set = res.excluded
+		line = strings.TrimSpace(line[1:])
+	}
+	if !set.Add(rulePrefixCidr + line) {
+		res.invalid++
+	}
+}
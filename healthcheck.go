@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -35,12 +36,17 @@ func (pc *persistConn) String() string {
 // addr isn't sealed into this struct since it's a high-level item
 type Transport struct {
 	avgDialTime int64 // Cumulative moving average dial time in ns(i.e. time.Duration)
+	refs        int32 // Reference count, a transport may be shared across Corefile reloads
 
 	recursionDesired bool          // RD flag
 	expire           time.Duration // [sic] After this duration a connection is expired
 	tlsConfig        *tls.Config
 
 	conns [typeTotalCount][]*persistConn // Buckets for udp, tcp and tcp-tls
+	// Labels for metrics
+	server string
+	to     string
+
 	dial  chan string
 	yield chan *persistConn
 	ret   chan *persistConn
@@ -72,11 +78,13 @@ func (t *Transport) connManager() {
 				if time.Since(pc.used) < t.expire {
 					// Found one, remove from pool and return this conn.
 					t.conns[transType] = stack[:len(stack)-1]
+					t.updatePoolMetrics(transType)
 					t.ret <- pc
 					continue
 				}
 				// clear entire cache if the last conn is expired
 				t.conns[transType] = nil
+				t.updatePoolMetrics(transType)
 				// now, the connections being passed to closeConns() are not reachable from
 				// transport methods anymore. So, it's safe to close them in a separate goroutine
 				go closeConns(stack)
@@ -86,6 +94,7 @@ func (t *Transport) connManager() {
 		case pc := <-t.yield:
 			transType := t.transportTypeFromConn(pc)
 			t.conns[transType] = append(t.conns[transType], pc)
+			t.updatePoolMetrics(transType)
 
 		case <-ticker.C:
 			t.cleanup(false)
@@ -98,6 +107,13 @@ func (t *Transport) connManager() {
 	}
 }
 
+func (t *Transport) updatePoolMetrics(transType transportType) {
+	if len(t.to) == 0 {
+		return
+	}
+	PooledConnCount.WithLabelValues(t.server, t.to, transType.String()).Set(float64(len(t.conns[transType])))
+}
+
 func closeConns(conns []*persistConn) {
 	for _, pc := range conns {
 		Close(pc.c)
@@ -114,6 +130,7 @@ func (t *Transport) cleanup(all bool) {
 		}
 		if all {
 			t.conns[transType] = nil
+			t.updatePoolMetrics(transportType(transType))
 			// now, the connections being passed to closeConns() are not reachable from
 			// transport methods anymore. So, it's safe to close them in a separate goroutine
 			go closeConns(stack)
@@ -129,6 +146,7 @@ func (t *Transport) cleanup(all bool) {
 			return stack[i].used.After(staleTime)
 		})
 		t.conns[transType] = stack[firstGood:]
+		t.updatePoolMetrics(transportType(transType))
 		log.Debugf("Going to cleanup expired connection(s): %v count: %v", stack[0].c.RemoteAddr(), firstGood)
 		// now, the connections being passed to closeConns() are not reachable from
 		// transport methods anymore. So, it's safe to close them in a separate goroutine
@@ -154,11 +172,19 @@ func (t *Transport) Yield(pc *persistConn) {
 	}
 }
 
-// Start starts the transport's connection manager.
-func (t *Transport) Start() { go t.connManager() }
+// Start starts the transport's connection manager, if it's not running yet.
+func (t *Transport) Start() {
+	if atomic.AddInt32(&t.refs, 1) == 1 {
+		go t.connManager()
+	}
+}
 
-// Stop stops the transport's connection manager.
-func (t *Transport) Stop() { close(t.stop) }
+// Stop stops the transport's connection manager once the last reference is gone.
+func (t *Transport) Stop() {
+	if atomic.AddInt32(&t.refs, -1) == 0 {
+		close(t.stop)
+	}
+}
 
 // UpstreamHostDownFunc can be used to customize how Down behaves
 // see: proxy/healthcheck/healthcheck.go
@@ -166,8 +192,9 @@ type UpstreamHostDownFunc func(*UpstreamHost) bool
 
 // UpstreamHost represents a single upstream DNS server
 type UpstreamHost struct {
-	proto string // DNS protocol, i.e. "udp", "tcp", etc.
-	addr  string // IP:PORT
+	proto  string // DNS protocol, i.e. "udp", "tcp", etc.
+	addr   string // IP:PORT
+	server string // Server address, used as label of metrics
 
 	fails    int32                // Fail count
 	downFunc UpstreamHostDownFunc // This function should be side-effect safe
@@ -181,6 +208,9 @@ type UpstreamHost struct {
 
 	httpClient         *http.Client
 	requestContentType string
+
+	// Hosts with the same identity can take over states from each other across Corefile reloads
+	identity string
 }
 
 func (uh *UpstreamHost) Name() string {
@@ -344,24 +374,26 @@ func (uh *UpstreamHost) Dial(proto string, bootstrap []string, noIPv6 bool) (*pe
 	uh.transport.dial <- proto
 	pc := <-uh.transport.ret
 	if pc != nil {
+		ConnCount.WithLabelValues(uh.server, uh.Name(), "1").Inc()
 		return pc, true, nil
 	}
 
 	reqTime := time.Now()
 	timeout := uh.transport.dialTimeout()
+	var conn *dns.Conn
+	var err error
 	if proto == "tcp-tls" {
-		conn, err := dialTimeoutWithTLS(proto, uh.addr, uh.transport.tlsConfig, timeout, bootstrap, noIPv6)
-		uh.transport.updateDialTimeout(time.Since(reqTime))
-		if err != nil {
-			return nil, false, err
-		}
-		return &persistConn{c: conn}, false, err
+		conn, err = dialTimeoutWithTLS(proto, uh.addr, uh.transport.tlsConfig, timeout, bootstrap, noIPv6)
+	} else {
+		conn, err = dialTimeout(proto, uh.addr, timeout, bootstrap, noIPv6)
 	}
-	conn, err := dialTimeout(proto, uh.addr, timeout, bootstrap, noIPv6)
-	uh.transport.updateDialTimeout(time.Since(reqTime))
+	dialTime := time.Since(reqTime)
+	uh.transport.updateDialTimeout(dialTime)
+	DialDuration.WithLabelValues(uh.server, uh.Name()).Observe(float64(dialTime.Milliseconds()))
 	if err != nil {
 		return nil, false, err
 	}
+	ConnCount.WithLabelValues(uh.server, uh.Name(), "0").Inc()
 	return &persistConn{c: conn}, false, err
 }
 
@@ -393,6 +425,7 @@ func (uh *UpstreamHost) dohExchange(ctx context.Context, state *request.Request)
 		return nil, err
 	}
 	defer Close(resp.Body)
+	DohStatusCount.WithLabelValues(uh.server, uh.Name(), strconv.Itoa(resp.StatusCode)).Inc()
 
 	contentType := strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0]
 	switch contentType {
@@ -473,17 +506,28 @@ func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bo
 // 	basically anything else constitutes a healthy upstream.
 func (uh *UpstreamHost) Check() error {
 	if err, rtt := uh.send(); err != nil {
-		HealthCheckFailureCount.WithLabelValues(uh.Name()).Inc()
+		HealthCheckFailureCount.WithLabelValues(uh.server, uh.Name()).Inc()
 		atomic.AddInt32(&uh.fails, 1)
+		uh.updateStateMetrics()
 		log.Warningf("hc: DNS %v failed  rtt: %v err: %v", uh.Name(), rtt, err)
 		return err
 	} else {
 		// Reset failure counter once health check success
 		atomic.StoreInt32(&uh.fails, 0)
+		uh.updateStateMetrics()
 		return nil
 	}
 }
 
+func (uh *UpstreamHost) updateStateMetrics() {
+	var up float64
+	if uh.downFunc == nil || !uh.downFunc(uh) {
+		up = 1
+	}
+	HostUp.WithLabelValues(uh.server, uh.Name()).Set(up)
+	HostFails.WithLabelValues(uh.server, uh.Name()).Set(float64(atomic.LoadInt32(&uh.fails)))
+}
+
 func (uh *UpstreamHost) send() (error, time.Duration) {
 	if uh.IsDOH() {
 		return uh.dohSend()
@@ -544,7 +588,6 @@ func (uh *UpstreamHost) Down() bool {
 	down := uh.downFunc(uh)
 	if down {
 		log.Debugf("%v marked as down...", uh.Name())
-		HealthCheckAllDownCount.WithLabelValues(uh.Name()).Inc()
 	}
 	return down
 }
@@ -557,6 +600,10 @@ type HealthCheck struct {
 	policy Policy
 	spray  Policy
 
+	// Hosts specified in name list, keyed by upstream in the form of HostPort()
+	entryLock  sync.RWMutex
+	entryHosts map[string]*UpstreamHost
+
 	// [PENDING]
 	//failTimeout time.Duration	// Single health check timeout
 
@@ -588,12 +635,25 @@ func (hc *HealthCheck) Stop() {
 	for _, host := range hc.hosts {
 		host.transport.Stop()
 	}
+
+	hc.entryLock.Lock()
+	for _, host := range hc.entryHosts {
+		host.transport.Stop()
+	}
+	hc.entryHosts = nil
+	hc.entryLock.Unlock()
 }
 
 func (hc *HealthCheck) healthCheck() {
 	for _, host := range hc.hosts {
 		go host.Check()
 	}
+
+	hc.entryLock.RLock()
+	for _, host := range hc.entryHosts {
+		go host.Check()
+	}
+	hc.entryLock.RUnlock()
 }
 
 func (hc *HealthCheck) healthCheckWorker() {
@@ -616,8 +676,11 @@ func (hc *HealthCheck) healthCheckWorker() {
 func (hc *HealthCheck) Select() *UpstreamHost {
 	pool := hc.hosts
 	if len(pool) == 1 {
-		if pool[0].Down() && hc.spray == nil {
-			return nil
+		if pool[0].Down() {
+			HealthCheckAllDownCount.WithLabelValues(pool[0].server).Inc()
+			if hc.spray == nil {
+				return nil
+			}
 		}
 		return pool[0]
 	}
@@ -630,6 +693,7 @@ func (hc *HealthCheck) Select() *UpstreamHost {
 		}
 	}
 	if allDown {
+		HealthCheckAllDownCount.WithLabelValues(pool[0].server).Inc()
 		if hc.spray == nil {
 			return nil
 		}
@@ -659,6 +723,16 @@ func (hc *HealthCheck) Select() *UpstreamHost {
 	return hc.spray.Select(pool)
 }
 
+// Select a healthy host other than the excluded ones in list order, nil if none
+func (hc *HealthCheck) selectExcept(excluded map[*UpstreamHost]struct{}) *UpstreamHost {
+	for _, host := range hc.hosts {
+		if _, found := excluded[host]; !found && !host.Down() {
+			return host
+		}
+	}
+	return nil
+}
+
 const (
 	defaultConnExpire = 15 * time.Second
 	minDialTimeout    = 1 * time.Second
@@ -0,0 +1,103 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+)
+
+// List of IP addresses and CIDRs, specified inline, or loaded from files and URLs in the cidr format
+// see: domestic_ip, bogus_nxdomain and reject_answer_ip
+type ipList struct {
+	// Arguments of the option, nil if not specified
+	args []string
+	nets *cidrSet
+	list *NameList
+}
+
+func newIPList() *ipList {
+	return &ipList{
+		nets: newCidrSet(),
+		list: &NameList{
+			stopPathReload: make(chan struct{}),
+			stopUrlReload:  make(chan struct{}),
+		},
+	}
+}
+
+// Parse `CIDR|FILE|URL...' of the current directive, untagged files and URLs are in the cidr format
+// Multiple lines of the same directive are merged together
+func (l *ipList) parse(c *caddy.Controller) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	for _, arg := range args {
+		if addr, _ := SplitByByte(arg, '/'); net.ParseIP(addr) != nil {
+			if !l.nets.Add(arg) {
+				return c.Errf("%v: bad CIDR %q", dir, arg)
+			}
+			continue
+		}
+		if err := checkNamePath(c, arg); err != nil {
+			return err
+		}
+		items, err := NewNameItemsWithForms([]string{arg})
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if item.format == nameFormatAuto {
+				item.format = nameFormatCidr
+			}
+		}
+		l.list.addItems(items)
+	}
+	l.args = append(l.args, args...)
+	log.Infof("%v: %v", dir, args)
+	return nil
+}
+
+// Check if the IP address is within the list
+func (l *ipList) Contains(addr netip.Addr) bool {
+	return l.nets.ContainsIP(addr) || l.list.ContainsIP(addr)
+}
+
+// Check if any A/AAAA address in the answer section is within the list
+func (l *ipList) ContainsAny(reply *dns.Msg) bool {
+	if l.args == nil {
+		return false
+	}
+	for _, addr := range answerIPs(reply) {
+		if l.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return A/AAAA addresses in the answer section, IPv4-mapped IPv6 addresses are taken as IPv4
+func answerIPs(reply *dns.Msg) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range reply.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,151 @@
+package dnsredir
+
+import (
+	"context"
+	"fmt"
+	"github.com/coredns/caddy"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIPList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bogus.txt")
+	if err := os.WriteFile(path, []byte("# ISP hijack pages\n61.139.8.101\n!61.139.8.0/25\n61.139.8.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := caddy.NewTestController("dns", fmt.Sprintf("bogus_nxdomain 0.0.0.0 ::ffff:127.0.0.0/104 %v", path))
+	c.Next()
+	l := newIPList()
+	if err := l.parse(c); err != nil {
+		t.Fatalf("parse() failed: %v", err)
+	}
+	l.list.updateList(NameItemTypePath, nil)
+
+	tests := []struct {
+		answer    []string
+		contained bool
+	}{
+		{nil, false},
+		{[]string{"example.com. 60 IN A 0.0.0.0"}, true},
+		{[]string{"example.com. 60 IN A 1.1.1.1", "example.com. 60 IN A 127.0.0.2"}, true},
+		{[]string{"example.com. 60 IN AAAA ::ffff:127.0.0.1"}, true},
+		{[]string{"example.com. 60 IN AAAA ::1"}, false},
+		{[]string{"example.com. 60 IN A 61.139.8.200"}, true},
+		// Negated in the list
+		{[]string{"example.com. 60 IN A 61.139.8.101"}, false},
+		{[]string{"example.com. 60 IN TXT \"0.0.0.0\""}, false},
+	}
+	for i, test := range tests {
+		if l.ContainsAny(newTestReply(t, test.answer...)) != test.contained {
+			t.Errorf("Test case#%v failed, expected contained: %v", i, test.contained)
+		}
+	}
+
+	c = caddy.NewTestController("dns", "reject_answer_ip 10.0.0.0/33")
+	c.Next()
+	if err := newIPList().parse(c); err == nil {
+		t.Errorf("Expected error for bad CIDR")
+	}
+}
+
+func newTestReply(t *testing.T, answer ...string) *dns.Msg {
+	reply := new(dns.Msg)
+	for _, s := range answer {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply.Answer = append(reply.Answer, rr)
+	}
+	return reply
+}
+
+// Local DNS server(UDP and TCP on the same port) which answers every A query with a fixed address
+type testServer struct {
+	addr string
+	// Number of queries received
+	queries int32
+	// Drop queries if nonzero
+	drop int32
+	// Delay of replies in nanoseconds
+	delay int64
+}
+
+// Unlike the default one, messages of all opcodes(e.g. UPDATE) are handled
+func acceptAll(dh dns.Header) dns.MsgAcceptAction {
+	return dns.MsgAccept
+}
+
+func startTestServer(t *testing.T, ip string) *testServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{addr: pc.LocalAddr().String()}
+	l, err := net.Listen("tcp", ts.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&ts.queries, 1)
+		if atomic.LoadInt32(&ts.drop) != 0 {
+			return
+		}
+		time.Sleep(time.Duration(atomic.LoadInt64(&ts.delay)))
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+		if opt := r.IsEdns0(); opt != nil {
+			m.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		_ = w.WriteMsg(m)
+	})
+	for _, server := range []*dns.Server{
+		{PacketConn: pc, MsgAcceptFunc: acceptAll, Handler: handler},
+		{Listener: l, MsgAcceptFunc: acceptAll, Handler: handler},
+	} {
+		go func() { _ = server.ActivateAndServe() }()
+		t.Cleanup(func() { _ = server.Shutdown() })
+	}
+	return ts
+}
+
+func TestRejectAnswerIP(t *testing.T) {
+	poisoned := startTestServer(t, "0.0.0.0")
+	clean := startTestServer(t, "93.184.216.34")
+	input := fmt.Sprintf(`
+dnsredir . {
+	to %v %v
+	policy sequential
+	health_check 0
+	reject_answer_ip 0.0.0.0
+}
+`, poisoned.addr, clean.addr)
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed: %v", err)
+	}
+	u := up.(*reloadableUpstream)
+	u.HealthCheck.Start()
+	defer u.HealthCheck.Stop()
+
+	state := newTestRequest("example.com", dns.TypeA)
+	state.W = &coretest.ResponseWriter{}
+	res := exchangeWithRetry(context.Background(), state, u, u.HealthCheck, u.Select, time.Now().Add(defaultTimeout))
+	if res.err != nil {
+		t.Fatalf("exchangeWithRetry() failed: %v", res.err)
+	}
+	if res.host.addr != clean.addr || res.tryCount != 2 {
+		t.Errorf("Expected reply from %v on the second try, got %v on try %v", clean.addr, res.host.addr, res.tryCount)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"github.com/coredns/coredns/request"
+	"strings"
+)
+
+// Combined index of names across all blocks, see: longest_match
+// Each name of suffix and full rules is mapped to blocks which list or except it in any domain set,
+// thus a lookup takes O(labels) hash probes, and only blocks which possibly match a suffix are probed
+//
+// The index is rebuilt in background after any name list changed, blocks changed since the index built
+// are probed for every suffix meanwhile, thus lookups never miss names added to the index lately
+type matchIndex struct {
+	// Name → indexes of blocks in ascending order
+	names map[string][]int
+	// Blocks which have keyword, glob, regexp or cidr rules, they're always probed for the query name itself
+	patterns []int
+	// Generations of the plugin and each block when the index built, see: Dnsredir.blockUpdated()
+	gen  uint64
+	gens []uint64
+}
+
+func newMatchIndex(ups []Upstream, gen uint64) *matchIndex {
+	idx := &matchIndex{names: make(map[string][]int), gen: gen, gens: make([]uint64, len(ups))}
+	for i, up := range ups {
+		u := up.(*reloadableUpstream)
+		// Read before the scan, changes during the scan mark the block as changed
+		idx.gens[i] = u.indexGen.Load()
+		hasPatterns := false
+		u.forEachDomainSet(func(d *domainSet) {
+			_ = d.ForEachDomain(func(name string) error {
+				blocks := idx.names[name]
+				if len(blocks) == 0 || blocks[len(blocks)-1] != i {
+					idx.names[name] = append(blocks, i)
+				}
+				return nil
+			})
+			if d.hasPatterns() {
+				hasPatterns = true
+			}
+		})
+		if hasPatterns {
+			idx.patterns = append(idx.patterns, i)
+		}
+	}
+	return idx
+}
+
+// Return indexes of blocks which possibly list or except `suffix', in ascending order
+// `changed' are blocks changed since the index built
+func (idx *matchIndex) candidates(suffix string, whole bool, changed []int) []int {
+	blocks := idx.names[suffix]
+	if whole && len(idx.patterns) != 0 {
+		blocks = mergeSorted(blocks, idx.patterns)
+	}
+	if len(changed) != 0 {
+		blocks = mergeSorted(blocks, changed)
+	}
+	return blocks
+}
+
+// Return indexes of blocks changed since the index built, in ascending order
+func (idx *matchIndex) changedBlocks(r *Dnsredir) []int {
+	if r.indexGen.Load() == idx.gen {
+		return nil
+	}
+	var changed []int
+	for i, up := range *r.Upstreams {
+		if up.(*reloadableUpstream).indexGen.Load() != idx.gens[i] {
+			changed = append(changed, i)
+		}
+	}
+	return changed
+}
+
+// Merge two ascending integer slices, duplicates are removed
+func mergeSorted(a, b []int) []int {
+	merged := make([]int, 0, len(a)+len(b))
+	for len(a) != 0 || len(b) != 0 {
+		var v int
+		switch {
+		case len(b) == 0 || (len(a) != 0 && a[0] < b[0]):
+			v, a = a[0], a[1:]
+		case len(a) == 0 || b[0] < a[0]:
+			v, b = b[0], b[1:]
+		default:
+			v, a, b = a[0], a[1:], b[1:]
+		}
+		merged = append(merged, v)
+	}
+	return merged
+}
+
+// Return a function which calls `f' and then `g', `f' can be nil
+func chainUpdate(f, g func()) func() {
+	if f == nil {
+		return g
+	}
+	return func() {
+		f()
+		g()
+	}
+}
+
+// Return the callback of name list changes of the block
+func (r *Dnsredir) blockUpdated(u *reloadableUpstream) func() {
+	return func() {
+		// Block generation goes first, see: matchIndex.changedBlocks()
+		u.indexGen.Add(1)
+		r.indexGen.Add(1)
+		r.invalidateIndex()
+	}
+}
+
+// Build the match index synchronously, called once name lists are loaded at startup
+func (r *Dnsredir) buildIndex() *matchIndex {
+	idx := newMatchIndex(*r.Upstreams, r.indexGen.Load())
+	r.index.Store(idx)
+	return idx
+}
+
+// Return the match index, built on first use if it's not built at startup
+func (r *Dnsredir) matchIndex() *matchIndex {
+	if idx := r.index.Load(); idx != nil {
+		return idx
+	}
+	return r.buildIndex()
+}
+
+// Schedule a rebuild of the match index, called after any name list changed
+// Rebuilds requested while building are coalesced, the previous index is served meanwhile
+func (r *Dnsredir) invalidateIndex() {
+	r.indexLock.Lock()
+	r.indexDirty = true
+	if r.indexBuilding {
+		r.indexLock.Unlock()
+		return
+	}
+	r.indexBuilding = true
+	r.indexLock.Unlock()
+
+	go func() {
+		for {
+			r.indexLock.Lock()
+			if !r.indexDirty {
+				r.indexBuilding = false
+				r.indexLock.Unlock()
+				return
+			}
+			r.indexDirty = false
+			r.indexLock.Unlock()
+
+			r.buildIndex()
+		}
+	}()
+}
+
+// Like proxy plugin, find the upstream with the longest(i.e. most specific) match
+// Suffixes of `name' are visited from the most specific one, the first upstream which lists the suffix wins
+// An upstream which excepts a suffix is excluded from all less specific suffixes
+// Full, keyword, glob and regexp rules match the query name itself, i.e. the most specific suffix
+// The root zone "." is the least specific one, thus upstreams which match any request serve as fallbacks
+// Upstreams whose conditions other than the query name aren't satisfied are skipped
+func (r *Dnsredir) longestMatchUpstream(state *request.Request, name string) Upstream {
+	ups := *r.Upstreams
+	idx := r.matchIndex()
+	changed := idx.changedBlocks(r)
+	excepted := make([]bool, len(ups))
+	for i, up := range ups {
+		excepted[i] = !up.Accept(state)
+	}
+
+	if name != "." {
+		for suffix := name; ; {
+			for _, i := range idx.candidates(suffix, suffix == name, changed) {
+				if excepted[i] {
+					continue
+				}
+				listed, ignored := ups[i].Lookup(suffix, suffix == name)
+				if ignored {
+					excepted[i] = true
+					continue
+				}
+				if listed {
+					return ups[i]
+				}
+			}
+
+			j := strings.IndexByte(suffix, '.')
+			if j <= 0 {
+				break
+			}
+			suffix = suffix[j+1:]
+		}
+	}
+
+	for i, up := range ups {
+		if !excepted[i] && up.(*reloadableUpstream).matchAny {
+			return up
+		}
+	}
+	return nil
+}
@@ -20,6 +20,13 @@ var (
 		Help:      "Histogram of the time(in milliseconds) each name lookup took.",
 	}, []string{"server", "matched"})
 
+	BlockMatchCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "block_match_count_total",
+		Help:      "Counter of the names matched per block.",
+	}, []string{"server", "block"})
+
 	requestBuckets = []float64{
 		15, 30, 50, 75, 100, 200, 350, 500, 750, 1000, 2000, 4000, 8000,
 	}
@@ -45,19 +52,144 @@ var (
 		Help:      "Rcode counter of requests made per upstream.",
 	}, []string{"server", "to", "rcode"})
 
-	// XXX: currently server not embedded into hc failure count label
 	HealthCheckFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
 		Name:      "hc_failure_count_total",
 		Help:      "Counter of the number of failed healthchecks.",
-	}, []string{"to"})
+	}, []string{"server", "to"})
 
-	// XXX: Ditto.
 	HealthCheckAllDownCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
 		Name:      "hc_all_down_count_total",
 		Help:      "Counter of the number of complete failures of the healthchecks.",
-	}, []string{"to"})
+	}, []string{"server"})
+
+	HostUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "host_up",
+		Help:      "Gauge of whether the upstream host is up(1) or down(0).",
+	}, []string{"server", "to"})
+
+	HostFails = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "host_fails",
+		Help:      "Gauge of the current failure count of the upstream host.",
+	}, []string{"server", "to"})
+
+	PooledConnCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "pooled_conn_count",
+		Help:      "Gauge of the pooled connections per upstream host and transport type.",
+	}, []string{"server", "to", "type"})
+
+	dialBuckets = []float64{
+		1, 5, 10, 25, 50, 75, 100, 200, 350, 500, 750, 1000, 2000, 5000,
+	}
+	DialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "dial_duration_ms",
+		Buckets:   dialBuckets,
+		Help:      "Histogram of the time(in milliseconds) each dial to upstream host took.",
+	}, []string{"server", "to"})
+
+	ConnCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "conn_count_total",
+		Help:      "Counter of the connections used per upstream host, cached or newly established.",
+	}, []string{"server", "to", "cached"})
+
+	retryBuckets = []float64{
+		0, 1, 2, 3, 5, 8, 10, 15, 20,
+	}
+	RetryCount = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "request_retry_count",
+		Buckets:   retryBuckets,
+		Help:      "Histogram of the retries each request took.",
+	}, []string{"server"})
+
+	DohStatusCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "doh_status_count_total",
+		Help:      "Counter of HTTP status codes per DNS over HTTPS upstream.",
+	}, []string{"server", "to", "status"})
+
+	NameListEntryCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "name_list_entry_count",
+		Help:      "Gauge of the domain names loaded per FROM item.",
+	}, []string{"server", "from"})
+
+	NameListReloadTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "name_list_reload_timestamp_seconds",
+		Help:      "Gauge of the last successful reload time(in unix seconds) per FROM item.",
+	}, []string{"server", "from"})
+
+	NameListReloadFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "name_list_reload_failure_count_total",
+		Help:      "Counter of the failed reloads per FROM item.",
+	}, []string{"server", "from"})
+
+	NameListVerifyFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "name_list_verify_failure_count_total",
+		Help:      "Counter of the URL contents failed to verify per FROM item.",
+	}, []string{"server", "from"})
+
+	NameListRejectCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "name_list_reject_count_total",
+		Help:      "Counter of the new contents rejected by max_shrink or max_invalid per FROM item.",
+	}, []string{"server", "from", "reason"})
+
+	ReplyGroupCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "reply_group_count_total",
+		Help:      "Counter of the replies chosen per upstream group, see: foreign and domestic_ip.",
+	}, []string{"server", "group"})
+
+	BogusReplyCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "bogus_reply_count_total",
+		Help:      "Counter of the replies rewritten by bogus_nxdomain or rejected by reject_answer_ip per upstream.",
+	}, []string{"server", "to", "action"})
+
+	CacheRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "cache_request_count_total",
+		Help:      "Counter of the requests looked up in block caches per result.",
+	}, []string{"server", "result"})
+
+	CachePrefetchCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "cache_prefetch_count_total",
+		Help:      "Counter of the cache entries refreshed by prefetch.",
+	}, []string{"server"})
+
+	CoalescedRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "coalesced_request_count_total",
+		Help:      "Counter of the requests which shared the exchange of an identical request in flight.",
+	}, []string{"server"})
 )
@@ -2,134 +2,335 @@ package dnsredir
 
 import (
 	"bufio"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/transport"
 	"golang.org/x/net/idna"
 	"io"
+	"math/rand"
+	"net"
+	"net/netip"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// uint16 used to store first two ASCII characters
-type domainSet map[uint16]StringSet
+// Domain set consists of several tiers of rules, matched in order of their costs
+//
+//	DOMAIN or domain:DOMAIN  DOMAIN and all its subdomains
+//	full:DOMAIN              DOMAIN only
+//	keyword:KEYWORD          Names contain KEYWORD
+//	*.cdn.*.example.com      Glob, `*' and `?' match within a single label
+//	regexp:REGEXP            Names match REGEXP, compiled once per reload
+//	cidr:CIDR                Reverse DNS names(in-addr.arpa and ip6.arpa) within CIDR
+//
+// Suffix rules are kept as-is, each lookup probes the name and its parent suffixes one by one
+// Thus a suffix lookup takes at most O(labels) hash probes, regardless of the domain set size
+type domainSet struct {
+	suffix map[string]struct{}
+	full   map[string]struct{}
+	// Suffix and full rules loaded from a snapshot, nil if none, see: snapshot.go
+	suffixTable *nameTable
+	fullTable   *nameTable
+	keyword     []string
+	glob        []string
+	regexp      []*regexp.Regexp
+	// nil if there's no cidr: rule
+	cidr *cidrSet
+}
 
-func (d domainSet) String() string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("%T[", d))
+// Prefixes of domain set rules
+const (
+	rulePrefixDomain  = "domain:"
+	rulePrefixFull    = "full:"
+	rulePrefixKeyword = "keyword:"
+	rulePrefixRegexp  = "regexp:"
+	rulePrefixCidr    = "cidr:"
+)
 
-	var i uint64
-	n := d.Len()
-	for _, s := range d {
-		for name := range s {
-			sb.WriteString(name)
-			if i++; i != n {
-				sb.WriteString(", ")
-			}
-		}
+func newDomainSet() *domainSet {
+	return &domainSet{
+		suffix: make(map[string]struct{}),
+		full:   make(map[string]struct{}),
 	}
-	sb.WriteString("]")
+}
 
-	return sb.String()
+func (d *domainSet) String() string {
+	return fmt.Sprintf("%T[%v]", d, strings.Join(d.Rules(), ", "))
 }
 
-// Return total number of domains in the domain set
+// Return all rules in the form accepted by domainSet.Add(), suffix rules come without prefix
+func (d *domainSet) Rules() []string {
+	var rules []string
+	if d != nil {
+		for name := range d.suffix {
+			rules = append(rules, name)
+		}
+		d.suffixTable.forEach(func(name string) {
+			rules = append(rules, name)
+		})
+		for name := range d.full {
+			rules = append(rules, rulePrefixFull+name)
+		}
+		d.fullTable.forEach(func(name string) {
+			rules = append(rules, rulePrefixFull+name)
+		})
+		for _, keyword := range d.keyword {
+			rules = append(rules, rulePrefixKeyword+keyword)
+		}
+		rules = append(rules, d.glob...)
+		for _, re := range d.regexp {
+			rules = append(rules, rulePrefixRegexp+re.String())
+		}
+		for _, p := range d.cidr.Prefixes() {
+			rules = append(rules, rulePrefixCidr+p)
+		}
+	}
+	return rules
+}
+
+// Return total number of rules in the domain set
 func (d *domainSet) Len() uint64 {
-	var n uint64
-	for _, s := range *d {
-		n += uint64(len(s))
+	if d == nil {
+		return 0
 	}
-	return n
+	return uint64(len(d.suffix) + len(d.full) + d.suffixTable.Len() + d.fullTable.Len() +
+		len(d.keyword) + len(d.glob) + len(d.regexp) + d.cidr.Len())
 }
 
-func domainToIndex(s string) uint16 {
-	n := len(s)
-	if n == 0 {
-		panic(fmt.Sprintf("Unexpected empty string?!"))
+// Convert a string(possibly an IDN) to a domain name
+// Returned string is lower cased and without trailing dot
+func toDomain(str string) (string, bool) {
+	name, ok := stringToDomain(str)
+	if ok {
+		return name, true
 	}
-	// Since we use two ASCII characters to present index
-	//	Insufficient length will padded with '-'
-	//	Since a valid domain segment will never begin with '-'
-	//	So it can maintain balance between buckets
-	if n == 1 {
-		return (uint16('-') << 8) | uint16(s[0])
+	name, err := idna.ToASCII(str)
+	// idna.ToASCII("") return no error
+	if err != nil || len(name) == 0 {
+		return "", false
 	}
-	// The index will be encoded in big endian
-	return (uint16(s[0]) << 8) | uint16(s[1])
+	// idna.ToASCII() is lenient, validate the result again
+	return stringToDomain(name)
 }
 
-// Return true if name added successfully, false otherwise
+// Add a rule, see: domainSet
+// Return true if rule added successfully, false otherwise
 func (d *domainSet) Add(str string) bool {
+	switch {
+	case strings.HasPrefix(str, rulePrefixDomain):
+		return d.addSuffix(str[len(rulePrefixDomain):])
+	case strings.HasPrefix(str, rulePrefixFull):
+		return d.addFull(str[len(rulePrefixFull):])
+	case strings.HasPrefix(str, rulePrefixKeyword):
+		return d.addKeyword(str[len(rulePrefixKeyword):])
+	case strings.HasPrefix(str, rulePrefixRegexp):
+		return d.addRegexp(str[len(rulePrefixRegexp):])
+	case strings.HasPrefix(str, rulePrefixCidr):
+		return d.addCidr(str[len(rulePrefixCidr):])
+	case strings.ContainsAny(str, "*?"):
+		return d.addGlob(str)
+	}
+	return d.addSuffix(str)
+}
+
+func (d *domainSet) addSuffix(str string) bool {
 	// To reduce memory, we don't use full qualified name
+	name, ok := toDomain(str)
+	if !ok {
+		return false
+	}
+	d.suffix[name] = struct{}{}
+	return true
+}
 
-	name, ok := stringToDomain(str)
+func (d *domainSet) addFull(str string) bool {
+	name, ok := toDomain(str)
 	if !ok {
-		var err error
-		name, err = idna.ToASCII(str)
-		// idna.ToASCII("") return no error
-		if err != nil || len(name) == 0 {
-			return false
-		}
+		return false
 	}
+	d.full[name] = struct{}{}
+	return true
+}
 
-	// To speed up name lookup, we utilized two-way hash
-	// The first one is the first two ASCII characters of the domain name
-	// The second one is the real domain set
-	// Which works somewhat like ordinary English dictionary lookup
-	s := (*d)[domainToIndex(name)]
-	if s == nil {
-		// MT-Unsafe: Initialize real domain set on demand
-		s = make(StringSet)
-		(*d)[domainToIndex(name)] = s
+func (d *domainSet) addKeyword(str string) bool {
+	keyword := strings.ToLower(str)
+	if len(keyword) == 0 || strings.ContainsAny(keyword, " \t") {
+		return false
+	}
+	d.keyword = append(d.keyword, keyword)
+	return true
+}
+
+func (d *domainSet) addGlob(str string) bool {
+	pattern := removeTrailingDot(strings.ToLower(str))
+	// Wildcards must be valid within labels
+	if _, ok := stringToDomain(strings.NewReplacer("*", "a", "?", "a").Replace(pattern)); !ok {
+		return false
+	}
+	d.glob = append(d.glob, pattern)
+	return true
+}
+
+func (d *domainSet) addRegexp(str string) bool {
+	re, err := regexp.Compile(str)
+	if err != nil {
+		return false
 	}
-	s.Add(name)
+	d.regexp = append(d.regexp, re)
 	return true
 }
 
+func (d *domainSet) addCidr(str string) bool {
+	if d.cidr == nil {
+		d.cidr = newCidrSet()
+	}
+	return d.cidr.Add(str)
+}
+
+// Check if the IP address is within any CIDR rule
+func (d *domainSet) ContainsIP(addr netip.Addr) bool {
+	return d != nil && d.cidr.ContainsIP(addr)
+}
+
+// Iterate over domain names of suffix and full rules
 // for loop will exit in advance if f() return error
 func (d *domainSet) ForEachDomain(f func(name string) error) error {
-	for _, s := range *d {
-		for name := range s {
+	if d == nil {
+		return nil
+	}
+	for _, m := range []map[string]struct{}{d.suffix, d.full} {
+		for name := range m {
 			if err := f(name); err != nil {
 				return err
 			}
 		}
 	}
+	for _, t := range []*nameTable{d.suffixTable, d.fullTable} {
+		for i := 0; i < t.Len(); i++ {
+			if err := f(string(t.at(i))); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+func (d *domainSet) hasSuffix(name string) bool {
+	_, found := d.suffix[name]
+	return found || d.suffixTable.Contains(name)
+}
+
+func (d *domainSet) hasFull(name string) bool {
+	_, found := d.full[name]
+	return found || d.fullTable.Contains(name)
+}
+
+// Check if the domain set has rules other than suffix and full rules
+func (d *domainSet) hasPatterns() bool {
+	return d != nil && len(d.keyword)+len(d.glob)+len(d.regexp)+d.cidr.Len() != 0
+}
+
+// Return true if exactly `name' in the domain set, either as a suffix rule or a full rule
+func (d *domainSet) Contains(name string) bool {
+	if d == nil {
+		return false
+	}
+	return d.hasSuffix(name) || d.hasFull(name)
+}
+
+// Check if `suffix' is exactly listed as a suffix rule
+// If `whole' is true, i.e. `suffix' is the query name itself, rules other than suffix rules are checked as well
+func (d *domainSet) Lookup(suffix string, whole bool) bool {
+	if d == nil {
+		return false
+	}
+	if d.hasSuffix(suffix) {
+		return true
+	}
+	return whole && d.matchWhole(suffix)
+}
+
 // Assume `child' is lower cased and without trailing dot
 func (d *domainSet) Match(child string) bool {
 	if len(child) == 0 {
 		panic(fmt.Sprintf("Why child is an empty string?!"))
 	}
+	if d == nil {
+		return false
+	}
 
-	for {
-		s := (*d)[domainToIndex(child)]
-		// Fast lookup for a full match
-		if s.Contains(child) {
+	for name := child; ; {
+		if d.hasSuffix(name) {
 			return true
 		}
 
-		// Fallback to iterate the whole set
-		for parent := range s {
-			if plugin.Name(parent).Matches(child) {
-				return true
-			}
-		}
-
-		i := strings.Index(child, ".")
+		i := strings.IndexByte(name, '.')
 		if i <= 0 {
 			break
 		}
-		child = child[i+1:]
+		name = name[i+1:]
 	}
 
+	return d.matchWhole(child)
+}
+
+// Match rules which apply to the whole name, i.e. full, keyword, glob, regexp and cidr rules
+func (d *domainSet) matchWhole(name string) bool {
+	if d.hasFull(name) {
+		return true
+	}
+	for _, keyword := range d.keyword {
+		if strings.Contains(name, keyword) {
+			return true
+		}
+	}
+	for _, pattern := range d.glob {
+		if globMatch(pattern, name) {
+			return true
+		}
+	}
+	for _, re := range d.regexp {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	if d.cidr != nil {
+		if p, ok := reverseNameToPrefix(name); ok && d.cidr.Contains(p) {
+			return true
+		}
+	}
 	return false
 }
 
+// Match `name' against `pattern' label by label, thus both must have the same number of labels
+func globMatch(pattern, name string) bool {
+	for {
+		i := strings.IndexByte(pattern, '.')
+		j := strings.IndexByte(name, '.')
+		if (i < 0) != (j < 0) {
+			return false
+		}
+		if i < 0 {
+			matched, _ := path.Match(pattern, name)
+			return matched
+		}
+		if matched, _ := path.Match(pattern[:i], name[:j]); !matched {
+			return false
+		}
+		pattern = pattern[i+1:]
+		name = name[j+1:]
+	}
+}
+
 const (
 	NameItemTypePath = iota
 	NameItemTypeUrl
@@ -138,39 +339,102 @@ const (
 
 type NameItem struct {
 	sync.RWMutex
+	// Serializes updates, since the name item may be shared by several name lists
+	updating sync.Mutex
+	// Number of successful updates from URL, increased while holding updating
+	fetches atomic.Uint64
 
 	// Domain name set for lookups
-	names domainSet
+	names *domainSet
+	// Domain names excluded from the whole name list, e.g. @@||DOMAIN^ in Adblock Plus rules
+	excluded *domainSet
+	// Upstream host per domain name, only populated if NameList.dnsmasqUpstream is set
+	upstreams map[string]string
 
 	whichType int
+	// Content format, see: format.go
+	format string
+	// geosite category, e.g. cn
+	category string
 
-	path  string
-	mtime time.Time
-	size  int64
+	// Glob pattern or directory which the path name item expanded from, empty if none
+	// If path is empty, it's the pattern itself, and expanded on each path reload
+	pattern string
+	path    string
+	mtime   time.Time
+	size    int64
 
 	url         string
 	contentHash uint64
+	// Validators of last response, for conditional request
+	etag         string
+	lastModified string
+	// Options of URL name item, nil if none
+	options *urlOptions
+	// Content passed verification of options.verifier, see: url_option
+	verified bool
+	// Per-item overrides of url_reload and its read timeout, zero to inherit from NameList
+	// Negative reload means the URL name item is never reloaded
+	reload  time.Duration
+	timeout time.Duration
+}
+
+func (item *NameItem) populated() bool {
+	item.RLock()
+	defer item.RUnlock()
+	return item.names != nil
+}
+
+// Return path or URL of the name item
+func (item *NameItem) source() string {
+	src := item.path
+	if item.whichType == NameItemTypeUrl {
+		src = item.url
+	}
+	if len(item.category) != 0 {
+		src += ":" + item.category
+	}
+	return src
 }
 
 func NewNameItemsWithForms(forms []string) ([]*NameItem, error) {
 	items := make([]*NameItem, len(forms))
 	for i, from := range forms {
+		format, from, category := splitCategory(splitFormat(from))
+		if format == nameFormatGeosite && len(category) == 0 {
+			return nil, errors.New(fmt.Sprintf("No geosite category specified in %q, e.g. geosite.dat:cn", from))
+		}
 		if j := strings.Index(from, "://"); j > 0 {
 			proto := strings.ToLower(from[:j])
 			if proto == "http" {
-				log.Warningf("Due to security reasons, URL %q is prohibited", from)
-				continue
-			}
-			if proto != "https" {
+				log.Warningf("URL %q is insecure, consider verifying it via url_option", from)
+			} else if proto != "https" {
 				return nil, errors.New(fmt.Sprintf("Unsupport URL %q", from))
 			}
+			theUrl, reload, timeout, err := splitReloadParams(from)
+			if err != nil {
+				return nil, err
+			}
 			items[i] = &NameItem{
 				whichType: NameItemTypeUrl,
-				url:       from,
+				format:    format,
+				category:  category,
+				url:       theUrl,
+				reload:    reload,
+				timeout:   timeout,
+			}
+		} else if isNamePattern(from) {
+			items[i] = &NameItem{
+				whichType: NameItemTypePath,
+				format:    format,
+				category:  category,
+				pattern:   from,
 			}
 		} else {
 			items[i] = &NameItem{
 				whichType: NameItemTypePath,
+				format:    format,
+				category:  category,
 				path:      from,
 			}
 		}
@@ -178,9 +442,111 @@ func NewNameItemsWithForms(forms []string) ([]*NameItem, error) {
 	return items, nil
 }
 
+// Strip `reload' and `timeout' query parameters from an URL, which override url_reload of the URL only
+// e.g. https://example.com/list.txt?reload=6h&timeout=60s
+// Other query parameters are left intact
+func splitReloadParams(theUrl string) (string, time.Duration, time.Duration, error) {
+	i := strings.IndexByte(theUrl, '?')
+	if i < 0 {
+		return theUrl, 0, 0, nil
+	}
+	var reload, timeout time.Duration
+	var params []string
+	for _, param := range strings.Split(theUrl[i+1:], "&") {
+		key, value := param, ""
+		if j := strings.IndexByte(param, '='); j >= 0 {
+			key, value = param[:j], param[j+1:]
+		}
+		switch key {
+		case "reload":
+			dur, err := parseDuration0(key, value)
+			if err != nil {
+				return "", 0, 0, errors.New(fmt.Sprintf("%q: %v", theUrl, err))
+			}
+			if dur == 0 {
+				reload = -1
+			} else if dur < minUrlReloadInterval {
+				return "", 0, 0, errors.New(fmt.Sprintf("%q: minimal reload interval is %v", theUrl, minUrlReloadInterval))
+			} else {
+				reload = dur
+			}
+		case "timeout":
+			dur, err := parseDuration0(key, value)
+			if err != nil {
+				return "", 0, 0, errors.New(fmt.Sprintf("%q: %v", theUrl, err))
+			}
+			if dur < minUrlReadTimeout {
+				return "", 0, 0, errors.New(fmt.Sprintf("%q: minimal read timeout is %v", theUrl, minUrlReadTimeout))
+			}
+			timeout = dur
+		default:
+			params = append(params, param)
+		}
+	}
+	stripped := theUrl[:i]
+	if len(params) != 0 {
+		stripped += "?" + strings.Join(params, "&")
+	}
+	return stripped, reload, timeout, nil
+}
+
+// Check if a FROM path is a glob pattern, e.g. lists.d/*.conf, or a directory
+func isNamePattern(from string) bool {
+	if strings.ContainsAny(from, "*?[") {
+		return true
+	}
+	st, err := os.Stat(from)
+	return err == nil && st.IsDir()
+}
+
+// Return regular files matched by a glob pattern, or in a directory
+// Hidden files in a directory are skipped, they're usually temporary files of editors
+func expandNamePattern(pattern string) ([]string, error) {
+	var paths []string
+	if strings.ContainsAny(pattern, "*?[") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		paths = matches
+	} else {
+		entries, err := os.ReadDir(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), ".") {
+				paths = append(paths, filepath.Join(pattern, entry.Name()))
+			}
+		}
+	}
+
+	files := paths[:0]
+	for _, p := range paths {
+		// Follow symbolic links
+		if st, err := os.Stat(p); err == nil && st.Mode().IsRegular() {
+			files = append(files, p)
+		}
+	}
+	return files, nil
+}
+
 type NameList struct {
-	// List of name items
-	items []*NameItem
+	// List of name items, guarded by itemsLock since path patterns are expanded on the fly
+	items     []*NameItem
+	itemsLock sync.RWMutex
+	// Glob patterns and directories, see: NameItem.pattern
+	patterns []*NameItem
+	// Name items are acquired from sharedItems once started, see: registry.go
+	shared bool
+
+	// Server address, used as label of metrics
+	server string
+
+	// Honor the upstream field in dnsmasq server=/DOMAIN/UPSTREAM lines
+	dnsmasqUpstream bool
+	// Called after any name item content changed
+	onUpdate func()
 
 	// All name items shared the same reload duration
 
@@ -190,33 +556,312 @@ type NameList struct {
 	urlReload      time.Duration
 	urlReadTimeout time.Duration
 	stopUrlReload  chan struct{}
+	// Directory to persist last good copy of URL name items, empty to disable
+	urlCache string
+
+	// Reject new content of a name item if it shrinks by more than maxShrink percent,
+	// or more than maxInvalid percent of its rules are invalid, zero to disable
+	maxShrink  int
+	maxInvalid int
 }
 
 // Assume `child' is lower cased and without trailing dot
 func (n *NameList) Match(child string) bool {
+	n.itemsLock.RLock()
+	defer n.itemsLock.RUnlock()
+
+	matched := false
 	for _, item := range n.items {
 		item.RLock()
-		if item.names.Match(child) {
+		if item.excluded.Match(child) {
 			item.RUnlock()
-			return true
+			return false
+		}
+		if !matched && item.names.Match(child) {
+			matched = true
 		}
 		item.RUnlock()
 	}
-	return false
+	return matched
+}
+
+// Check if the IP address is within any CIDR rule of name items, and not excluded by any of them
+func (n *NameList) ContainsIP(addr netip.Addr) bool {
+	n.itemsLock.RLock()
+	defer n.itemsLock.RUnlock()
+
+	contained := false
+	for _, item := range n.items {
+		item.RLock()
+		if item.excluded.ContainsIP(addr) {
+			item.RUnlock()
+			return false
+		}
+		if !contained && item.names.ContainsIP(addr) {
+			contained = true
+		}
+		item.RUnlock()
+	}
+	return contained
+}
+
+// Check if exactly `suffix' is listed in, or excluded from any name item, see: domainSet.Lookup()
+func (n *NameList) Lookup(suffix string, whole bool) (bool, bool) {
+	n.itemsLock.RLock()
+	defer n.itemsLock.RUnlock()
+
+	listed := false
+	for _, item := range n.items {
+		item.RLock()
+		if item.excluded.Lookup(suffix, whole) {
+			item.RUnlock()
+			return false, true
+		}
+		if !listed && item.names.Lookup(suffix, whole) {
+			listed = true
+		}
+		item.RUnlock()
+	}
+	return listed, false
+}
+
+// Iterate over domain sets of name items, both listed and excluded ones
+func (n *NameList) forEachDomainSet(f func(d *domainSet)) {
+	n.itemsLock.RLock()
+	defer n.itemsLock.RUnlock()
+
+	for _, item := range n.items {
+		item.RLock()
+		f(item.names)
+		f(item.excluded)
+		item.RUnlock()
+	}
+}
+
+// Return upstream host of the most specific domain name which `child' matched, empty if none
+// Assume `child' is lower cased and without trailing dot
+func (n *NameList) MatchUpstream(child string) string {
+	n.itemsLock.RLock()
+	defer n.itemsLock.RUnlock()
+
+	for {
+		for _, item := range n.items {
+			item.RLock()
+			upstream, found := item.upstreams[child]
+			item.RUnlock()
+			if found {
+				return upstream
+			}
+		}
+
+		i := strings.IndexByte(child, '.')
+		if i <= 0 {
+			break
+		}
+		child = child[i+1:]
+	}
+	return ""
+}
+
+// Return all distinct upstream hosts in name items
+func (n *NameList) Upstreams() StringSet {
+	set := make(StringSet)
+	for _, item := range n.snapshot() {
+		item.RLock()
+		for _, upstream := range item.upstreams {
+			if len(upstream) != 0 {
+				set.Add(upstream)
+			}
+		}
+		item.RUnlock()
+	}
+	return set
+}
+
+// Return a copy of name items, which can be iterated without holding itemsLock
+func (n *NameList) snapshot() []*NameItem {
+	n.itemsLock.RLock()
+	defer n.itemsLock.RUnlock()
+	return append([]*NameItem(nil), n.items...)
+}
+
+// Add name items, glob patterns and directories are expanded immediately
+func (n *NameList) addItems(items []*NameItem) {
+	for _, item := range items {
+		if item.whichType == NameItemTypePath && len(item.path) == 0 {
+			n.patterns = append(n.patterns, item)
+			continue
+		}
+		n.itemsLock.Lock()
+		n.items = append(n.items, item)
+		n.itemsLock.Unlock()
+	}
+	n.expandPatterns()
+}
+
+// Expand glob patterns and directories, new files are added as name items, and deleted files are dropped
+// Return true if any name item dropped
+func (n *NameList) expandPatterns() bool {
+	if len(n.patterns) == 0 {
+		return false
+	}
+
+	n.itemsLock.Lock()
+	defer n.itemsLock.Unlock()
+
+	// Path name items of each pattern
+	expanded := make(map[string]map[string]bool)
+	for _, pattern := range n.patterns {
+		paths, err := expandNamePattern(pattern.pattern)
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Debugf("%v", err)
+			} else {
+				// Keep current name items if the pattern cannot be expanded temporarily
+				log.Warningf("Cannot expand %q, err: %v", pattern.pattern, err)
+				expanded[pattern.pattern] = nil
+				continue
+			}
+		}
+		set := make(map[string]bool)
+		for _, p := range paths {
+			set[p] = true
+		}
+		expanded[pattern.pattern] = set
+	}
+
+	dropped := false
+	items := n.items[:0]
+	for _, item := range n.items {
+		if set, ok := expanded[item.pattern]; ok && len(item.pattern) != 0 && set != nil {
+			if !set[item.path] {
+				log.Infof("%v removed from %q", item.path, item.pattern)
+				if n.shared {
+					n.releaseItem(item)
+				}
+				NameListEntryCount.DeleteLabelValues(n.server, item.source())
+				NameListReloadTimestamp.DeleteLabelValues(n.server, item.source())
+				dropped = true
+				continue
+			}
+			// Already a name item
+			delete(set, item.path)
+		}
+		items = append(items, item)
+	}
+	// Don't leave dropped name items reachable from the backing array
+	for i := len(items); i < len(n.items); i++ {
+		n.items[i] = nil
+	}
+
+	for _, pattern := range n.patterns {
+		var paths []string
+		for p := range expanded[pattern.pattern] {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			log.Infof("%v added from %q", p, pattern.pattern)
+			item := &NameItem{
+				whichType: NameItemTypePath,
+				format:    pattern.format,
+				category:  pattern.category,
+				pattern:   pattern.pattern,
+				path:      p,
+			}
+			if n.shared {
+				item = n.acquireItem(item)
+			}
+			items = append(items, item)
+		}
+	}
+	n.items = items
+	return dropped
+}
+
+// Share the same server and reload settings with another name list, e.g. FROM...
+func (n *NameList) inheritReload(from *NameList) {
+	n.server = from.server
+	n.pathReload = from.pathReload
+	n.urlReload = from.urlReload
+	n.urlReadTimeout = from.urlReadTimeout
+	n.urlCache = from.urlCache
+	n.maxShrink = from.maxShrink
+	n.maxInvalid = from.maxInvalid
+	n.resetReload()
+}
+
+// Reset reload intervals to zero if there's no corresponding name item
+func (n *NameList) resetReload() {
+	hasPath := len(n.patterns) != 0
+	hasUrl := false
+	for _, item := range n.snapshot() {
+		switch item.whichType {
+		case NameItemTypePath:
+			hasPath = true
+		case NameItemTypeUrl:
+			hasUrl = true
+		default:
+			panic(fmt.Sprintf("Unexpected NameItem type %v", item.whichType))
+		}
+	}
+	if !hasPath && n.pathReload != 0 {
+		log.Debugf("Reset path_reload %v to zero since no path found", n.pathReload)
+		n.pathReload = 0
+	}
+	if !hasUrl && n.urlReload != 0 {
+		log.Debugf("Reset url_reload %v to zero since no url found", n.urlReload)
+		n.urlReload = 0
+	}
+}
+
+// Return effective reload interval of an URL name item, zero if it's never reloaded
+func (n *NameList) urlReloadOf(item *NameItem) time.Duration {
+	if item.reload < 0 {
+		return 0
+	}
+	if item.reload > 0 {
+		return item.reload
+	}
+	return n.urlReload
+}
+
+// Return effective read timeout of an URL name item
+func (n *NameList) urlReadTimeoutOf(item *NameItem) time.Duration {
+	if item.timeout > 0 {
+		return item.timeout
+	}
+	return n.urlReadTimeout
 }
 
 // MT-Unsafe
 func (n *NameList) periodicUpdate(bootstrap []string) {
+	n.acquireItems()
+
 	// Kick off initial name list content population
 	n.updateList(NameItemTypeLast, bootstrap)
 
 	if n.pathReload > 0 {
+		// Changes of watched files are signaled immediately, polling serves as a fallback
+		changed := make(chan struct{}, 1)
+		cancels, allWatched := n.watchPaths(changed)
+		interval := n.pathReload
+		if allWatched && interval < watchedPollInterval {
+			interval = watchedPollInterval
+		}
+
 		go func() {
-			ticker := time.NewTicker(n.pathReload)
+			ticker := time.NewTicker(interval)
 			for {
 				select {
 				case <-n.stopPathReload:
+					ticker.Stop()
+					for _, cancel := range cancels {
+						cancel()
+					}
 					return
+				case <-changed:
+					n.updateList(NameItemTypePath, bootstrap)
 				case <-ticker.C:
 					n.updateList(NameItemTypePath, bootstrap)
 				}
@@ -224,23 +869,110 @@ func (n *NameList) periodicUpdate(bootstrap []string) {
 		}()
 	}
 
-	if n.urlReload > 0 {
-		go func() {
-			ticker := time.NewTicker(n.urlReload)
-			for {
-				select {
-				case <-n.stopUrlReload:
-					return
-				case <-ticker.C:
-					n.updateList(NameItemTypeUrl, bootstrap)
-				}
+	for _, item := range n.snapshot() {
+		if item.whichType != NameItemTypeUrl {
+			continue
+		}
+		if reload := n.urlReloadOf(item); reload > 0 {
+			go n.periodicUpdateUrl(item, reload, bootstrap)
+		}
+	}
+}
+
+// Each URL name item is reloaded on its own schedule, randomized by +/-10% on each round,
+// so that large lists, and lists of different blocks, won't be fetched at the same moment
+func (n *NameList) periodicUpdateUrl(item *NameItem, reload time.Duration, bootstrap []string) {
+	timer := time.NewTimer(jitterDuration(reload))
+	defer timer.Stop()
+	for {
+		select {
+		case <-n.stopUrlReload:
+			return
+		case <-timer.C:
+			// Shared name item is reloaded by the subscriber with the shortest interval only
+			if n.ownsItem(item) {
+				// Give up retrying once next reload is due
+				n.updateItemFromUrlWithRetry(item, bootstrap, time.Now().Add(reload))
 			}
-		}()
+			timer.Reset(jitterDuration(reload))
+		}
 	}
 }
 
+// Return a random duration in [d*0.9, d*1.1)
+func jitterDuration(d time.Duration) time.Duration {
+	return d - d/10 + time.Duration(rand.Int63n(int64(d/5)+1))
+}
+
+// Watch path name items, `changed' is signaled once any of them changed
+// Directories of glob patterns are watched as a whole, so new files can be picked up
+// Return functions to cancel the watches, and whether all path name items are watched
+func (n *NameList) watchPaths(changed chan struct{}) ([]func(), bool) {
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	var cancels []func()
+	allWatched := true
+	for _, pattern := range n.patterns {
+		dir := pattern.pattern
+		if strings.ContainsAny(dir, "*?[") {
+			dir = filepath.Dir(dir)
+		}
+		if strings.ContainsAny(dir, "*?[") {
+			log.Warningf("Cannot watch %q since its directory is a glob pattern, fallback to polling", pattern.pattern)
+			allWatched = false
+			continue
+		}
+		cancel, err := watchDir(dir, notify)
+		if err != nil {
+			log.Warningf("Cannot watch %q, fallback to polling, err: %v", dir, err)
+			allWatched = false
+			continue
+		}
+		cancels = append(cancels, cancel)
+	}
+
+	for _, item := range n.snapshot() {
+		// Expanded name items are covered by directory watches
+		if item.whichType != NameItemTypePath || len(item.pattern) != 0 {
+			continue
+		}
+		cancel, err := watchFile(item.path, notify)
+		if err != nil {
+			log.Warningf("Cannot watch %q, fallback to polling, err: %v", item.path, err)
+			allWatched = false
+			continue
+		}
+		cancels = append(cancels, cancel)
+
+		// Symbolic links(e.g. Kubernetes ConfigMap volumes) can be swapped without any event of the file itself
+		// Watch the directory of the link and the link target, and keep polling since the target may move
+		if target, err := filepath.EvalSymlinks(item.path); err == nil && target != filepath.Clean(item.path) {
+			log.Infof("%q is a symbolic link to %q, polled as per %v", item.path, target, "path_reload")
+			allWatched = false
+			if cancel, err := watchDir(filepath.Dir(item.path), notify); err == nil {
+				cancels = append(cancels, cancel)
+			}
+			if cancel, err := watchFile(target, notify); err == nil {
+				cancels = append(cancels, cancel)
+			}
+		}
+	}
+	return cancels, allWatched
+}
+
 func (n *NameList) updateList(whichType int, bootstrap []string) {
-	for _, item := range n.items {
+	if whichType == NameItemTypeLast || whichType == NameItemTypePath {
+		if n.expandPatterns() && n.onUpdate != nil {
+			n.onUpdate()
+		}
+	}
+
+	for _, item := range n.snapshot() {
 		if whichType == NameItemTypeLast || whichType == item.whichType {
 			switch item.whichType {
 			case NameItemTypePath:
@@ -249,7 +981,8 @@ func (n *NameList) updateList(whichType int, bootstrap []string) {
 				if whichType == NameItemTypeLast {
 					n.initialUpdateFromUrl(item, bootstrap)
 				} else {
-					_ = n.updateItemFromUrl(item, bootstrap)
+					// Give up retrying once next reload is due
+					n.updateItemFromUrlWithRetry(item, bootstrap, time.Now().Add(n.urlReloadOf(item)))
 				}
 			default:
 				panic(fmt.Sprintf("Unexpected NameItem type %v", whichType))
@@ -259,6 +992,9 @@ func (n *NameList) updateList(whichType int, bootstrap []string) {
 }
 
 func (n *NameList) updateItemFromPath(item *NameItem) {
+	item.updating.Lock()
+	defer item.updating.Unlock()
+
 	file, err := os.Open(item.path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -267,6 +1003,7 @@ func (n *NameList) updateItemFromPath(item *NameItem) {
 		} else {
 			log.Warningf("%v", err)
 		}
+		NameListReloadFailureCount.WithLabelValues(n.server, item.source()).Inc()
 		return
 	}
 	defer Close(file)
@@ -287,132 +1024,537 @@ func (n *NameList) updateItemFromPath(item *NameItem) {
 	}
 
 	t1 := time.Now()
-	names, totalLines := n.parse(file)
+	res, err := n.parse(file, item)
 	t2 := time.Since(t1)
-	log.Debugf("Parsed %v  time spent: %v name added: %v / %v",
-		file.Name(), t2, names.Len(), totalLines)
+	if err != nil {
+		log.Warningf("Failed to parse %v, err: %v", item.source(), err)
+		NameListReloadFailureCount.WithLabelValues(n.server, item.source()).Inc()
+		return
+	}
+	log.Debugf("Parsed %v  time spent: %v name added: %v excluded: %v / %v invalid: %v",
+		file.Name(), t2, res.names.Len(), res.excluded.Len(), res.totalLines, res.invalid)
+
+	if !n.checkGuards(item, res) {
+		// Don't parse it again until it changed
+		item.Lock()
+		item.mtime = stat.ModTime()
+		item.size = stat.Size()
+		item.Unlock()
+		return
+	}
 
 	item.Lock()
-	item.names = names
+	item.names = res.names
+	item.excluded = res.excluded
+	item.upstreams = res.upstreams
 	item.mtime = stat.ModTime()
 	item.size = stat.Size()
 	item.Unlock()
+
+	n.notifyUpdate(item, res.names)
+}
+
+// Check if the parse result is acceptable to replace current content of the name item
+// see: max_shrink and max_invalid
+func (n *NameList) checkGuards(item *NameItem, res *parseResult) bool {
+	count := res.names.Len() + res.excluded.Len()
+	if n.maxInvalid > 0 && res.invalid != 0 && res.invalid*100 > (count+res.invalid)*uint64(n.maxInvalid) {
+		log.Errorf("Rejected new content of %v, %v of %v rules are invalid, exceeds %v%%",
+			item.source(), res.invalid, count+res.invalid, n.maxInvalid)
+		NameListRejectCount.WithLabelValues(n.server, item.source(), "invalid").Inc()
+		return false
+	}
+
+	item.RLock()
+	count0 := item.names.Len() + item.excluded.Len()
+	item.RUnlock()
+	if n.maxShrink > 0 && count < count0 && (count0-count)*100 > count0*uint64(n.maxShrink) {
+		log.Errorf("Rejected new content of %v, shrinks from %v to %v rules, exceeds %v%%",
+			item.source(), count0, count, n.maxShrink)
+		NameListRejectCount.WithLabelValues(n.server, item.source(), "shrink").Inc()
+		return false
+	}
+	return true
+}
+
+func (n *NameList) updateItemMetrics(item *NameItem, names *domainSet) {
+	NameListEntryCount.WithLabelValues(n.server, item.source()).Set(float64(names.Len()))
+	NameListReloadTimestamp.WithLabelValues(n.server, item.source()).SetToCurrentTime()
 }
 
-func (n *NameList) parse(r io.Reader) (domainSet, uint64) {
-	names := make(domainSet)
+// Result of name item content parsing
+type parseResult struct {
+	names     *domainSet
+	excluded  *domainSet
+	upstreams map[string]string
+
+	totalLines uint64
+	invalid    uint64 // Lines which look like a rule, yet failed to parse
+}
+
+func (n *NameList) parse(r io.Reader, item *NameItem) (*parseResult, error) {
+	res := &parseResult{
+		names:    newDomainSet(),
+		excluded: newDomainSet(),
+	}
+	if n.dnsmasqUpstream {
+		res.upstreams = make(map[string]string)
+	}
+
+	format := item.format
+	if format == nameFormatGeosite {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := parseGeosite(data, item.category, res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	br := bufio.NewReader(r)
+	if format == nameFormatSnapshot || (format == nameFormatAuto && isSnapshot(br)) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		if res.names, res.excluded, err = decodeSnapshot(data); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	if format == nameFormatAuto && isGfwlist(br) {
+		format = nameFormatGfwlist
+	}
+	r = br
+	if format == nameFormatGfwlist {
+		// Line breaks are ignored by base64 decoder
+		r = base64.NewDecoder(base64.StdEncoding, br)
+		format = nameFormatAbp
+	}
 
-	var totalLines uint64
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		totalLines++
+		res.totalLines++
 
-		line := scanner.Text()
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
+		line := strings.TrimSpace(scanner.Text())
+		switch format {
+		case nameFormatHosts:
+			parseHostsLine(line, res)
+		case nameFormatAbp:
+			parseAbpLine(line, res)
+		case nameFormatClash:
+			parseClashLine(line, res)
+		case nameFormatSurge:
+			parseSurgeLine(line, res)
+		case nameFormatCidr:
+			parseCidrLine(line, res)
+		default:
+			n.parseAutoLine(line, res)
 		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
 
-		f := strings.Split(line, "/")
-		if len(f) != 3 {
-			// Treat the whole line as a domain name
-			_ = names.Add(line)
-			continue
+	return res, nil
+}
+
+func (n *NameList) parseAutoLine(line string, res *parseResult) {
+	switch {
+	case strings.HasPrefix(line, "server=/"):
+		n.parseDnsmasqServer(line, res)
+		return
+	case strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "|"):
+		parseAbpLine(line, res)
+		return
+	case (strings.HasPrefix(line, "DOMAIN-") || strings.HasPrefix(line, "DOMAIN,")) && strings.IndexByte(line, ',') > 0:
+		// Clash/Surge classical rules, a name like DOMAIN-NAMES.COM isn't
+		parseRuleLine(line, res)
+		return
+	case line == "payload:":
+		return
+	case strings.HasPrefix(line, "!"):
+		parseNegatedLine(line[1:], res)
+		return
+	case strings.HasPrefix(line, "[") || strings.HasPrefix(line, "/"):
+		// Adblock Plus headers and regex rules
+		return
+	case strings.Contains(line, "##") || strings.Contains(line, "#@#"):
+		// Adblock Plus element hiding rules
+		return
+	case strings.HasPrefix(line, "."):
+		// Adblock Plus domain rules, as seen in gfwlist
+		line = line[1:]
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if len(line) == 0 {
+		return
+	}
+	if i := strings.IndexAny(line, " \t"); i > 0 && net.ParseIP(line[:i]) != nil {
+		parseHostsLine(line, res)
+		return
+	}
+	// Treat the whole line as a domain name
+	if !res.names.Add(line) {
+		res.invalid++
+	}
+}
+
+// Negated entry, e.g. !www.example.com, which excludes the name from the whole name list
+// Otherwise it's an Adblock Plus comment, e.g. ! Title: foobar
+func parseNegatedLine(line string, res *parseResult) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if strings.ContainsAny(line, " \t") || (!strings.ContainsRune(line, '.') && !strings.HasPrefix(line, rulePrefixCidr)) {
+		return
+	}
+	// Comments like !foo.bar:baz are silently ignored
+	_ = res.excluded.Add(line)
+}
+
+// Format: server=/DOMAIN/[DOMAIN/...][UPSTREAM]
+// see: http://manpages.ubuntu.com/manpages/bionic/man8/dnsmasq.8.html
+func (n *NameList) parseDnsmasqServer(line string, res *parseResult) {
+	line = strings.TrimSpace(line[len("server=/"):])
+	// '#' is the port delimiter here, thus only whitespace leading '#' is treated as comment
+	if i := strings.Index(line, " #"); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+
+	// The upstream may be an URL which contains '/'
+	i := strings.Index(line, "://")
+	if i < 0 {
+		i = len(line)
+	}
+	i = strings.LastIndexByte(line[:i], '/')
+	if i < 0 {
+		log.Warningf("Malformed dnsmasq line: %q", line)
+		res.invalid++
+		return
+	}
+
+	var upstream string
+	if n.dnsmasqUpstream {
+		var ok bool
+		if upstream, ok = dnsmasqUpstreamToHost(line[i+1:]); !ok {
+			log.Warningf("%q isn't a valid upstream", line[i+1:])
 		}
+	}
 
-		// Format: server=/<domain>/<?>
-		if f[0] != "server=" {
+	for _, domain := range strings.Split(line[:i], "/") {
+		if !res.names.Add(domain) {
+			log.Warningf("%q isn't a domain name", domain)
+			res.invalid++
 			continue
 		}
+		// Empty upstream is kept as well, so a more specific domain can go to standard servers
+		if n.dnsmasqUpstream {
+			// Rules other than suffix rules have no upstream
+			if name, ok := toDomain(domain); ok {
+				res.upstreams[name] = upstream
+			}
+		}
+	}
+}
 
-		// Don't check f[2], see: http://manpages.ubuntu.com/manpages/bionic/man8/dnsmasq.8.html
-		// Thus server=/<domain>/<ip>, server=/<domain>/, server=/<domain>/# won't be honored
+// Convert dnsmasq upstream field to the form of HostPort()
+// Empty string is returned if the field denotes standard servers, i.e. `to TO...'
+// The field can be IP, IP#PORT or any transport supported by `to TO...'
+func dnsmasqUpstreamToHost(s string) (string, bool) {
+	// Empty field or # denote standard servers
+	if len(s) == 0 || s == "#" {
+		return "", true
+	}
 
-		if !names.Add(f[1]) {
-			log.Warningf("%q isn't a domain name", f[1])
+	if strings.Contains(s, "://") {
+		if strings.HasPrefix(strings.ToLower(s), "https://") {
+			// Assume it's a RFC 8484 DNS over HTTPS upstream
+			s = "ietf-doh://" + s[len("https://"):]
 		}
+		hosts, err := HostPort([]string{s})
+		if err != nil {
+			return "", false
+		}
+		return hosts[0], true
 	}
 
-	return names, totalLines
+	// Source address/interface isn't supported
+	s, _ = SplitByByte(s, '@')
+	host, port := SplitByByte(s, '#')
+	if len(port) != 0 {
+		port = port[1:]
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 0xffff {
+			return "", false
+		}
+	}
+	if net.ParseIP(stripZoneAndTlsName(host)) == nil {
+		return "", false
+	}
+	if len(port) == 0 {
+		port = transport.Port
+	}
+	return "dns://" + net.JoinHostPort(host, port), true
 }
 
 // Return true if NameItem updated
 func (n *NameList) updateItemFromUrl(item *NameItem, bootstrap []string) bool {
+	item.updating.Lock()
+	defer item.updating.Unlock()
+	return n.updateItemFromUrlLocked(item, bootstrap)
+}
+
+// Like updateItemFromUrl(), the caller must hold item.updating
+func (n *NameList) updateItemFromUrlLocked(item *NameItem, bootstrap []string) bool {
 	if item.whichType != NameItemTypeUrl || len(item.url) == 0 {
 		panic("Function call misuse or bad URL config")
 	}
+	if !n.fetchItemFromUrl(item, bootstrap) {
+		return false
+	}
+	item.fetches.Add(1)
+	return true
+}
+
+// Fetch and parse the URL name item, return true if it's updated or unchanged
+func (n *NameList) fetchItemFromUrl(item *NameItem, bootstrap []string) bool {
+	item.RLock()
+	names0 := item.names
+	contentHash := item.contentHash
+	// Content never verified must be fetched and verified, even if it's unchanged
+	unverified := item.options != nil && item.options.verifier != nil && !item.verified
+	req := &urlRequest{
+		url:         item.url,
+		contentType: "text/plain",
+		bootstrap:   bootstrap,
+		timeout:     n.urlReadTimeoutOf(item),
+		options:     item.options,
+	}
+	// Nothing to fallback to if not populated yet
+	if names0 != nil && !unverified {
+		req.etag = item.etag
+		req.lastModified = item.lastModified
+	}
+	item.RUnlock()
+	if item.format == nameFormatGeosite || item.format == nameFormatSnapshot {
+		// Binary content
+		req.contentType = ""
+	}
 
 	t1 := time.Now()
-	content, err := getUrlContent(item.url, "text/plain", bootstrap, n.urlReadTimeout)
+	resp, err := getUrlContent(req)
 	t2 := time.Since(t1)
 	if err != nil {
 		log.Warningf("Failed to update %q, err: %v", item.url, err)
+		NameListReloadFailureCount.WithLabelValues(n.server, item.source()).Inc()
 		return false
 	}
+	if resp.notModified {
+		log.Debugf("%v not modified, time spent: %v", item.url, t2)
+		n.updateItemMetrics(item, names0)
+		return true
+	}
 
-	item.RLock()
-	contentHash := item.contentHash
-	item.RUnlock()
-	contentHash1 := stringHash(content)
-	if contentHash1 == contentHash {
+	contentHash1 := stringHash(resp.content)
+	if contentHash1 == contentHash && !unverified {
+		item.Lock()
+		item.etag = resp.etag
+		item.lastModified = resp.lastModified
+		item.Unlock()
+		n.updateItemMetrics(item, names0)
 		return true
 	}
 
-	names := make(domainSet)
-	var totalLines uint64
+	var proof string
+	if item.options != nil && item.options.verifier != nil {
+		fetch := func(theUrl string) (string, error) {
+			resp, err := getUrlContent(&urlRequest{
+				url:       theUrl,
+				bootstrap: bootstrap,
+				timeout:   n.urlReadTimeoutOf(item),
+				// Credentials of the list aren't sent to another origin
+				options: item.options.forUrl(item.url, theUrl),
+			})
+			if err != nil {
+				return "", err
+			}
+			proof = resp.content
+			return resp.content, nil
+		}
+		if err := item.options.verifier.verify(item.url, resp.content, fetch); err != nil {
+			// Keep the previous content
+			log.Errorf("Failed to verify %q, err: %v", item.url, err)
+			NameListVerifyFailureCount.WithLabelValues(n.server, item.source()).Inc()
+			return false
+		}
+	}
+
 	t3 := time.Now()
-	lines := strings.Split(content, "\n")
-	for _, line := range lines {
-		totalLines++
+	res, err := n.parse(strings.NewReader(resp.content), item)
+	t4 := time.Since(t3)
+	if err != nil {
+		log.Warningf("Failed to parse %v, err: %v", item.source(), err)
+		NameListReloadFailureCount.WithLabelValues(n.server, item.source()).Inc()
+		return false
+	}
+	log.Debugf("Fetched %v, time spent: %v %v, added: %v excluded: %v / %v invalid: %v, hash: %#x",
+		item.url, t2, t4, res.names.Len(), res.excluded.Len(), res.totalLines, res.invalid, contentHash1)
 
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
-		}
+	if !n.checkGuards(item, res) {
+		// Don't parse it again until it changed
+		item.Lock()
+		item.contentHash = contentHash1
+		item.etag = resp.etag
+		item.lastModified = resp.lastModified
+		item.Unlock()
+		return true
+	}
 
-		f := strings.Split(line, "/")
-		if len(f) != 3 {
-			_ = names.Add(line)
-			continue
-		}
+	item.Lock()
+	item.names = res.names
+	item.excluded = res.excluded
+	item.upstreams = res.upstreams
+	item.contentHash = contentHash1
+	item.etag = resp.etag
+	item.lastModified = resp.lastModified
+	item.verified = item.options != nil && item.options.verifier != nil
+	item.Unlock()
 
-		if f[0] != "server=" {
-			continue
+	n.notifyUpdate(item, res.names)
+
+	if len(n.urlCache) != 0 {
+		header := &urlCacheHeader{
+			Url:          item.url,
+			ETag:         resp.etag,
+			LastModified: resp.lastModified,
+		}
+		if item.options != nil && item.options.verifier != nil {
+			header.ProofUrl = item.options.verifier.url
+			header.Proof = []byte(proof)
+		}
+		if err := storeUrlCache(n.urlCache, header, resp.content); err != nil {
+			log.Warningf("Failed to cache %q, err: %v", item.url, err)
 		}
+	}
+	return true
+}
+
+// Populate the name item from the on-disk cache(if any)
+// Return true if the name item populated
+func (n *NameList) loadItemFromCache(item *NameItem) bool {
+	item.updating.Lock()
+	defer item.updating.Unlock()
 
-		if !names.Add(f[1]) {
-			log.Warningf("%q isn't a domain name", f[1])
+	if item.populated() {
+		return false
+	}
+	header, content, err := loadUrlCache(n.urlCache, item.url)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Debugf("%q not cached yet", item.url)
+		} else {
+			log.Warningf("Failed to load cache of %q, err: %v", item.url, err)
+		}
+		return false
+	}
+	if item.options != nil && item.options.verifier != nil {
+		v := item.options.verifier
+		// The proof is stored along with the content, a changed verify option invalidates it
+		fetch := func(theUrl string) (string, error) {
+			if header.ProofUrl != theUrl || len(header.Proof) == 0 {
+				return "", errors.New("not cached")
+			}
+			return string(header.Proof), nil
+		}
+		if err := v.verify(item.url, content, fetch); err != nil {
+			log.Warningf("Failed to verify cache of %q, err: %v", item.url, err)
+			NameListVerifyFailureCount.WithLabelValues(n.server, item.source()).Inc()
+			return false
 		}
 	}
-	t4 := time.Since(t3)
-	log.Debugf("Fetched %v, time spent: %v %v, added: %v / %v, hash: %#x",
-		item.url, t2, t4, names.Len(), totalLines, contentHash1)
+
+	res, err := n.parse(strings.NewReader(content), item)
+	if err != nil {
+		log.Warningf("Failed to parse cache of %v, err: %v", item.source(), err)
+		return false
+	}
+	log.Infof("Loaded %v from cache, added: %v excluded: %v", item.url, res.names.Len(), res.excluded.Len())
 
 	item.Lock()
-	item.names = names
-	item.contentHash = contentHash1
+	item.names = res.names
+	item.excluded = res.excluded
+	item.upstreams = res.upstreams
+	item.contentHash = stringHash(content)
+	item.etag = header.ETag
+	item.lastModified = header.LastModified
+	item.verified = item.options != nil && item.options.verifier != nil
 	item.Unlock()
 
+	n.notifyUpdate(item, res.names)
 	return true
 }
 
+const (
+	urlRetryMinDelay = 1 * time.Second
+	urlRetryMaxDelay = 5 * time.Minute
+)
+
+// Retry with exponential backoff and jitter until succeed, stopped, or the deadline(if not zero) reached
+func (n *NameList) updateItemFromUrlWithRetry(item *NameItem, bootstrap []string, deadline time.Time) {
+	n.retryUntil(deadline, func() bool {
+		return n.updateItemFromUrl(item, bootstrap)
+	})
+}
+
+// Call `update' with exponential backoff and jitter until it returns true, stopped, or the deadline(if not zero) reached
+func (n *NameList) retryUntil(deadline time.Time, update func() bool) {
+	delay := urlRetryMinDelay
+	for !update() {
+		// Randomize in [delay/2, delay], to avoid retry storms against the server
+		d := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if !deadline.IsZero() && time.Now().Add(d).After(deadline) {
+			return
+		}
+		select {
+		case <-n.stopUrlReload:
+			return
+		case <-time.After(d):
+		}
+		if delay *= 2; delay > urlRetryMaxDelay {
+			delay = urlRetryMaxDelay
+		}
+	}
+}
+
 // Initial name list population needs a working DNS upstream
 //	thus we need to fallback to it(if any) in case of population failure
 func (n *NameList) initialUpdateFromUrl(item *NameItem, bootstrap []string) {
-	go func() {
-		// Fast retry in case of unstable network
-		retryIntervals := []time.Duration{
-			500 * time.Millisecond,
-			1500 * time.Millisecond,
-		}
-		i := 0
-		for {
-			if n.updateItemFromUrl(item, bootstrap) {
-				break
-			}
-			if i == len(retryIntervals) {
-				break
-			}
-			time.Sleep(retryIntervals[i])
-			i++
+	if item.populated() {
+		// Taken over from previous instance, or populated by another subscriber, wait for next reload
+		log.Debugf("Skip initial update of %q since it's already populated", item.url)
+		return
+	}
+
+	if len(n.urlCache) != 0 {
+		// Serve the last good copy before network is available
+		n.loadItemFromCache(item)
+	}
+
+	// Content may be populated from cache already, thus count fetches rather than checking populated()
+	fetches := item.fetches.Load()
+	go n.retryUntil(time.Time{}, func() bool {
+		item.updating.Lock()
+		defer item.updating.Unlock()
+		if item.fetches.Load() != fetches {
+			// Fetched by another subscriber of the shared name item meanwhile
+			log.Debugf("Skip initial update of %q since it's fetched by another subscriber", item.url)
+			return true
 		}
-	}()
+		return n.updateItemFromUrlLocked(item, bootstrap)
+	})
 }
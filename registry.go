@@ -0,0 +1,144 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name items are shared process-wide, so the same list referenced by several blocks(or server blocks)
+// is parsed, stored and reloaded only once, and every subscribed name list is notified on changes
+var sharedItems = struct {
+	sync.Mutex
+	m map[string]*sharedItem
+}{
+	m: make(map[string]*sharedItem),
+}
+
+type sharedItem struct {
+	item *NameItem
+	// Subscribed name lists in order of acquisition, the first one reloads the URL name item
+	subs []*NameList
+}
+
+// Item identity covers every setting which affects content of the name item
+func nameItemKey(n *NameList, item *NameItem) string {
+	var options string
+	if item.options != nil {
+		options = strings.Join(item.options.spec, "\n")
+	}
+	// Guards decide which content is accepted, blocks with different guards don't share name items
+	// Per-item reload overrides(e.g. ?reload=0) are carried by the name item itself
+	return fmt.Sprintf("%v %v %v %q %v %q %v %v %v %v",
+		item.whichType, item.format, item.source(), item.pattern, n.dnsmasqUpstream, options, n.maxShrink, n.maxInvalid,
+		item.reload, item.timeout)
+}
+
+// Subscribe to a name item, return the shared one if the same name item already acquired by others
+// Content and settings(e.g. reload interval of URL name item) of the first acquired one take effect
+func (n *NameList) acquireItem(item *NameItem) *NameItem {
+	key := nameItemKey(n, item)
+
+	sharedItems.Lock()
+	defer sharedItems.Unlock()
+
+	s := sharedItems.m[key]
+	if s == nil {
+		s = &sharedItem{item: item}
+		sharedItems.m[key] = s
+	}
+	s.subs = append(s.subs, n)
+	return s.item
+}
+
+// Unsubscribe from a name item, the next subscriber(if any) takes over reloading of it
+func (n *NameList) releaseItem(item *NameItem) {
+	key := nameItemKey(n, item)
+
+	sharedItems.Lock()
+	defer sharedItems.Unlock()
+
+	s := sharedItems.m[key]
+	if s == nil || s.item != item {
+		return
+	}
+	for i, sub := range s.subs {
+		if sub == n {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			break
+		}
+	}
+	if len(s.subs) == 0 {
+		delete(sharedItems.m, key)
+	}
+}
+
+// Acquire all name items, they're replaced by the shared ones
+func (n *NameList) acquireItems() {
+	n.itemsLock.Lock()
+	defer n.itemsLock.Unlock()
+
+	for i, item := range n.items {
+		n.items[i] = n.acquireItem(item)
+	}
+	n.shared = true
+}
+
+// Release all name items acquired
+func (n *NameList) releaseItems() {
+	n.itemsLock.Lock()
+	defer n.itemsLock.Unlock()
+
+	if !n.shared {
+		return
+	}
+	for _, item := range n.items {
+		n.releaseItem(item)
+	}
+	n.shared = false
+}
+
+// Return subscribed name lists of a name item, `n' is the only one if the name item isn't shared
+func (n *NameList) itemSubscribers(item *NameItem) []*NameList {
+	sharedItems.Lock()
+	defer sharedItems.Unlock()
+
+	if s := sharedItems.m[nameItemKey(n, item)]; s != nil && s.item == item {
+		for _, sub := range s.subs {
+			if sub == n {
+				return append([]*NameList(nil), s.subs...)
+			}
+		}
+	}
+	return []*NameList{n}
+}
+
+// Check if `n' is responsible for reloading the URL name item, i.e. the subscriber with the shortest url_reload
+// Subscribers which never reload it are skipped, ties are broken by order of acquisition
+func (n *NameList) ownsItem(item *NameItem) bool {
+	var owner *NameList
+	var shortest time.Duration
+	for _, sub := range n.itemSubscribers(item) {
+		reload := sub.urlReloadOf(item)
+		if reload > 0 && (owner == nil || reload < shortest) {
+			owner = sub
+			shortest = reload
+		}
+	}
+	return owner == n
+}
+
+// Notify every subscriber that content of the name item changed
+func (n *NameList) notifyUpdate(item *NameItem, names *domainSet) {
+	for _, sub := range n.itemSubscribers(item) {
+		sub.updateItemMetrics(item, names)
+		if sub.onUpdate != nil {
+			sub.onUpdate()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package dnsredir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSharedItems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.conf")
+	if err := os.WriteFile(path, []byte("example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := make(map[string]int)
+	newList := func(server string, dnsmasqUpstream bool, maxShrink int) *NameList {
+		n := &NameList{server: server, dnsmasqUpstream: dnsmasqUpstream, maxShrink: maxShrink, urlReload: time.Hour}
+		n.onUpdate = func() {
+			updated[server]++
+		}
+		items, err := NewNameItemsWithForms([]string{path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.addItems(items)
+		n.acquireItems()
+		return n
+	}
+	n1 := newList("n1", false, 0)
+	n2 := newList("n2", false, 0)
+	// Parsed differently, thus not shared
+	n3 := newList("n3", true, 0)
+	// Guarded differently, thus not shared either
+	n4 := newList("n4", false, 50)
+
+	if n1.items[0] != n2.items[0] || n1.items[0] == n3.items[0] || n1.items[0] == n4.items[0] {
+		t.Fatalf("Unexpected name item sharing")
+	}
+	if !n1.ownsItem(n1.items[0]) || n2.ownsItem(n2.items[0]) || !n3.ownsItem(n3.items[0]) {
+		t.Errorf("Unexpected name item owners")
+	}
+
+	n1.updateItemFromPath(n1.items[0])
+	// Already up-to-date
+	n2.updateItemFromPath(n2.items[0])
+	if !n1.Match("example.com") || !n2.Match("example.com") || n3.Match("example.com") {
+		t.Errorf("Shared name item not populated")
+	}
+	if updated["n1"] != 1 || updated["n2"] != 1 || updated["n3"] != 0 {
+		t.Errorf("Unexpected notifications: %v", updated)
+	}
+
+	item := n1.items[0]
+	n1.releaseItems()
+	if !n2.ownsItem(item) {
+		t.Errorf("Name item not handed over to the next subscriber")
+	}
+	n2.releaseItems()
+	n3.releaseItems()
+	n4.releaseItems()
+	if key := nameItemKey(n2, item); sharedItems.m[key] != nil {
+		t.Errorf("Name item not released")
+	}
+}
+
+func TestSharedItemOwner(t *testing.T) {
+	const theUrl = "https://example.com/owner.conf"
+	newList := func(reload time.Duration) *NameList {
+		n := &NameList{urlReload: reload}
+		items, err := NewNameItemsWithForms([]string{theUrl})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.addItems(items)
+		n.acquireItems()
+		return n
+	}
+	// The first subscriber never reloads it
+	n1 := newList(0)
+	n2 := newList(time.Hour)
+	n3 := newList(30 * time.Minute)
+	item := n1.items[0]
+	if n1.ownsItem(item) || n2.ownsItem(item) || !n3.ownsItem(item) {
+		t.Errorf("Name item should be owned by the subscriber with the shortest interval")
+	}
+	n3.releaseItems()
+	if !n2.ownsItem(item) {
+		t.Errorf("Name item not handed over to the subscriber which reloads it")
+	}
+	n2.releaseItems()
+	if n1.ownsItem(item) {
+		t.Errorf("Subscriber which never reloads shouldn't own the name item")
+	}
+	n1.releaseItems()
+
+	// Per-item reload overrides aren't shared
+	n4 := newList(time.Hour)
+	items, err := NewNameItemsWithForms([]string{theUrl + "?reload=0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n5 := &NameList{urlReload: time.Hour}
+	n5.addItems(items)
+	n5.acquireItems()
+	if n4.items[0] == n5.items[0] {
+		t.Errorf("Name items with different reload overrides shouldn't be shared")
+	}
+	n4.releaseItems()
+	n5.releaseItems()
+}
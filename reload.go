@@ -0,0 +1,151 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/coredns/caddy"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// When the reload plugin re-runs setup, the new instance is started before the old one is stopped.
+// Live upstreams are registered by block identity, so the new instance can take over
+// name lists, health states and pooled connections from the old one.
+var liveUpstreams = struct {
+	sync.Mutex
+	m map[string]*reloadableUpstream
+}{
+	m: make(map[string]*reloadableUpstream),
+}
+
+// Block identity is the server block keys along with FROM...
+func blockKey(c *caddy.Controller, u *reloadableUpstream) string {
+	return strings.Join(c.ServerBlockKeys, " ") + " " + pluginName + " " + strings.Join(u.from, " ")
+}
+
+// Host identity covers every setting which affects pooled connections of the host
+func hostIdentity(u *reloadableUpstream, uh *UpstreamHost) string {
+	var serverName string
+	if uh.transport.tlsConfig != nil {
+		serverName = uh.transport.tlsConfig.ServerName
+	}
+	return fmt.Sprintf("%v %v %v %v %v %v %v %v",
+		uh.Name(), uh.requestContentType, serverName, u.tlsArgs,
+		uh.transport.expire, uh.transport.recursionDesired, u.bootstrap, u.noIPv6)
+}
+
+// Register this upstream as the live one, and take over states from the previous one(if any)
+func (u *reloadableUpstream) takeOver() {
+	if len(u.key) == 0 {
+		return
+	}
+
+	liveUpstreams.Lock()
+	old := liveUpstreams.m[u.key]
+	liveUpstreams.m[u.key] = u
+	liveUpstreams.Unlock()
+
+	if old == nil || old == u {
+		return
+	}
+	items := u.NameList.takeOver(old.NameList) + u.exceptList.takeOver(old.exceptList)
+	oldLists := old.ipLists()
+	for i, l := range u.ipLists() {
+		items += l.list.takeOver(oldLists[i].list)
+	}
+	hosts := u.HealthCheck.takeOver(old.HealthCheck)
+	if u.foreign != nil && old.foreign != nil {
+		hosts += u.foreign.takeOver(old.foreign)
+	}
+	log.Infof("%v: took over %v name item(s) and %v host(s) from previous instance", u.from, items, hosts)
+}
+
+// Unregister this upstream if it's still the live one
+func (u *reloadableUpstream) giveUp() {
+	if len(u.key) == 0 {
+		return
+	}
+
+	liveUpstreams.Lock()
+	if liveUpstreams.m[u.key] == u {
+		delete(liveUpstreams.m, u.key)
+	}
+	liveUpstreams.Unlock()
+}
+
+// Take over unchanged name items from the old name list
+// Name items are unchanged only if every setting which affects their content is unchanged, see: nameItemKey()
+// Otherwise they're re-read, since validators(e.g. mtime and content hash) would skip the next reload
+// Return number of name items taken over
+func (n *NameList) takeOver(old *NameList) int {
+	count := 0
+	oldItems := old.snapshot()
+	for _, item := range n.snapshot() {
+		key := nameItemKey(n, item)
+		for _, oldItem := range oldItems {
+			if nameItemKey(old, oldItem) != key {
+				continue
+			}
+
+			oldItem.RLock()
+			names := oldItem.names
+			excluded := oldItem.excluded
+			upstreams := oldItem.upstreams
+			mtime := oldItem.mtime
+			size := oldItem.size
+			contentHash := oldItem.contentHash
+			etag := oldItem.etag
+			lastModified := oldItem.lastModified
+			verified := oldItem.verified
+			oldItem.RUnlock()
+			if names == nil {
+				// Never populated
+				break
+			}
+
+			// Name set is read-only once populated, it's safe to share it
+			item.Lock()
+			item.names = names
+			item.excluded = excluded
+			item.upstreams = upstreams
+			item.mtime = mtime
+			item.size = size
+			item.contentHash = contentHash
+			item.etag = etag
+			item.lastModified = lastModified
+			item.verified = verified
+			item.Unlock()
+			count++
+			break
+		}
+	}
+	return count
+}
+
+// Take over pooled connections and failure counts of unchanged hosts from the old health check
+// Must be called before hc.Start()
+// Return number of hosts taken over
+func (hc *HealthCheck) takeOver(old *HealthCheck) int {
+	count := 0
+	for _, host := range hc.hosts {
+		for _, oldHost := range old.hosts {
+			if host.identity != oldHost.identity {
+				continue
+			}
+
+			// Transport is reference counted, the old instance won't close it on its shutdown
+			host.transport = oldHost.transport
+			if oldHost.httpClient != nil {
+				host.httpClient = oldHost.httpClient
+			}
+			atomic.StoreInt32(&host.fails, atomic.LoadInt32(&oldHost.fails))
+			count++
+			break
+		}
+	}
+	return count
+}
@@ -0,0 +1,107 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/coredns/caddy"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTakeOver(t *testing.T) {
+	const input = "dnsredir foo.conf https://example.com/bar.conf { to 1.2.3.4 tls://5.6.7.8 \n }"
+
+	c := caddy.NewTestController("dns", input)
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatalf("NewReloadableUpstreams() failed: %v", err)
+	}
+	old := ups[0].(*reloadableUpstream)
+	old.takeOver()
+	defer old.giveUp()
+
+	old.items[0].names = newDomainSet()
+	old.items[0].names.Add("example.org")
+	old.items[1].names = newDomainSet()
+	old.items[1].names.Add("example.net")
+	old.items[1].contentHash = 0xdeadbeef
+	atomic.StoreInt32(&old.hosts[1].fails, 2)
+
+	// Same block identity, yet one upstream host changed
+	c = caddy.NewTestController("dns", "dnsredir foo.conf https://example.com/bar.conf { to 1.2.3.4 tls://8.8.8.8 \n }")
+	ups, err = NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatalf("NewReloadableUpstreams() failed: %v", err)
+	}
+	u := ups[0].(*reloadableUpstream)
+	if u.key != old.key {
+		t.Fatalf("Block identity mismatch: %q vs %q", u.key, old.key)
+	}
+	u.takeOver()
+	defer u.giveUp()
+
+	if !u.NameList.Match("www.example.org") || !u.NameList.Match("example.net") {
+		t.Errorf("Name items not taken over")
+	}
+	if u.items[1].contentHash != 0xdeadbeef {
+		t.Errorf("URL content hash not taken over")
+	}
+	if u.hosts[0].transport != old.hosts[0].transport {
+		t.Errorf("Transport of unchanged host %v not taken over", u.hosts[0].Name())
+	}
+	if u.hosts[1].transport == old.hosts[1].transport || atomic.LoadInt32(&u.hosts[1].fails) != 0 {
+		t.Errorf("States of changed host %v shouldn't be taken over", u.hosts[1].Name())
+	}
+
+	old.giveUp()
+	liveUpstreams.Lock()
+	live := liveUpstreams.m[u.key]
+	liveUpstreams.Unlock()
+	if live != u {
+		t.Errorf("Old instance shouldn't unregister the new one")
+	}
+}
+
+func TestTakeOverChangedSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.conf")
+	if err := os.WriteFile(path, []byte("server=/example.com/9.9.9.9\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		options  string
+		takeOver bool
+	}{
+		{"", true},
+		{"dnsmasq_upstream", false},
+		{"max_shrink 50", false},
+		{"max_invalid 10", false},
+	}
+	for i, test := range tests {
+		newUpstream := func(options string) *reloadableUpstream {
+			c := caddy.NewTestController("dns", fmt.Sprintf("dnsredir %v {\n to 1.1.1.1\n %v\n}", path, options))
+			ups, err := NewReloadableUpstreams(c)
+			if err != nil {
+				t.Fatalf("Test case#%v failed, NewReloadableUpstreams(): %v", i, err)
+			}
+			return ups[0].(*reloadableUpstream)
+		}
+		old := newUpstream("")
+		old.takeOver()
+		old.updateItemFromPath(old.items[0])
+
+		u := newUpstream(test.options)
+		u.takeOver()
+		if u.items[0].populated() != test.takeOver {
+			t.Errorf("Test case#%v failed, taken over: %v, expected: %v", i, u.items[0].populated(), test.takeOver)
+		}
+		// Re-read since validators aren't taken over
+		u.updateItemFromPath(u.items[0])
+		if u.dnsmasqUpstream && u.NameList.MatchUpstream("www.example.com") == "" {
+			t.Errorf("Test case#%v failed, upstream of dnsmasq server line not parsed", i)
+		}
+		u.giveUp()
+		old.giveUp()
+	}
+}
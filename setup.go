@@ -17,6 +17,22 @@ func setup(c *caddy.Controller) error {
 	}
 
 	r := &Dnsredir{Upstreams: &ups}
+	for _, up := range ups {
+		// Any block enables longest match for the whole plugin
+		if up.(*reloadableUpstream).longestMatch {
+			r.longestMatch = true
+			log.Infof("Longest match across %v block(s)", len(ups))
+			break
+		}
+	}
+	if r.longestMatch {
+		for _, up := range ups {
+			u := up.(*reloadableUpstream)
+			for _, n := range []*NameList{u.NameList, u.exceptList} {
+				n.onUpdate = chainUpdate(n.onUpdate, r.blockUpdated(u))
+			}
+		}
+	}
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		r.Next = next
 		return r
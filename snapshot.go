@@ -0,0 +1,241 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Snapshot is a precompiled domain set, which is loaded with a single read, without any line scanning or IDN conversion
+// Suffix and full rules are kept as sorted tables in the snapshot data, and looked up by binary search
+//
+// All integers are little endian uint32:
+//
+//	magic "DNSRSNAP"
+//	version
+//	domain set of names
+//	domain set of excluded names
+//	CRC-32(IEEE) of all above
+//
+// A domain set consists of six tables: suffix, full(both sorted), keyword, glob, regexp and cidr
+// A table of N strings is N, N+1 offsets into the blob, and the blob
+const (
+	snapshotMagic   = "DNSRSNAP"
+	snapshotVersion = 2
+)
+
+// Sorted table of names, which refers to snapshot data directly
+type nameTable struct {
+	// N+1 offsets into the blob
+	offsets []byte
+	blob    []byte
+}
+
+func (t *nameTable) Len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.offsets)/4 - 1
+}
+
+func (t *nameTable) offset(i int) uint32 {
+	return binary.LittleEndian.Uint32(t.offsets[4*i:])
+}
+
+func (t *nameTable) at(i int) []byte {
+	return t.blob[t.offset(i):t.offset(i+1)]
+}
+
+func (t *nameTable) Contains(name string) bool {
+	n := t.Len()
+	i := sort.Search(n, func(i int) bool {
+		return string(t.at(i)) >= name
+	})
+	return i < n && string(t.at(i)) == name
+}
+
+func (t *nameTable) forEach(f func(name string)) {
+	for i := 0; i < t.Len(); i++ {
+		f(string(t.at(i)))
+	}
+}
+
+func isSnapshot(br *bufio.Reader) bool {
+	magic, _ := br.Peek(len(snapshotMagic))
+	return string(magic) == snapshotMagic
+}
+
+// Compile FROM... paths into a snapshot, format tags, geosite categories and glob patterns are honored
+// Names and excluded names of all paths are merged, dnsmasq upstreams are discarded
+func CompileSnapshot(w io.Writer, froms []string) error {
+	items, err := NewNameItemsWithForms(froms)
+	if err != nil {
+		return err
+	}
+	n := &NameList{}
+	n.addItems(items)
+
+	names := newDomainSet()
+	excluded := newDomainSet()
+	for _, item := range n.items {
+		if item.whichType != NameItemTypePath {
+			return errors.New(fmt.Sprintf("%v: only paths can be compiled", item.source()))
+		}
+		file, err := os.Open(item.path)
+		if err != nil {
+			return err
+		}
+		res, err := n.parse(file, item)
+		Close(file)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v: %v", item.source(), err))
+		}
+		for _, rule := range res.names.Rules() {
+			names.Add(rule)
+		}
+		for _, rule := range res.excluded.Rules() {
+			excluded.Add(rule)
+		}
+	}
+	return encodeSnapshot(w, names, excluded)
+}
+
+func encodeSnapshot(w io.Writer, names, excluded *domainSet) error {
+	buf := []byte(snapshotMagic)
+	buf = binary.LittleEndian.AppendUint32(buf, snapshotVersion)
+	for _, d := range []*domainSet{names, excluded} {
+		var suffix, full, keyword, glob, regexps, cidrs []string
+		for _, rule := range d.Rules() {
+			switch {
+			case strings.HasPrefix(rule, rulePrefixFull):
+				full = append(full, rule[len(rulePrefixFull):])
+			case strings.HasPrefix(rule, rulePrefixKeyword):
+				keyword = append(keyword, rule[len(rulePrefixKeyword):])
+			case strings.HasPrefix(rule, rulePrefixRegexp):
+				regexps = append(regexps, rule[len(rulePrefixRegexp):])
+			case strings.HasPrefix(rule, rulePrefixCidr):
+				cidrs = append(cidrs, rule[len(rulePrefixCidr):])
+			default:
+				// Suffix rules never contain wildcards
+				if _, ok := stringToDomain(rule); ok {
+					suffix = append(suffix, rule)
+				} else {
+					glob = append(glob, rule)
+				}
+			}
+		}
+		sort.Strings(suffix)
+		sort.Strings(full)
+		for _, table := range [][]string{suffix, full, keyword, glob, regexps, cidrs} {
+			buf = appendNameTable(buf, table)
+		}
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendNameTable(buf []byte, names []string) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(names)))
+	offset := uint32(0)
+	buf = binary.LittleEndian.AppendUint32(buf, offset)
+	for _, name := range names {
+		offset += uint32(len(name))
+		buf = binary.LittleEndian.AppendUint32(buf, offset)
+	}
+	for _, name := range names {
+		buf = append(buf, name...)
+	}
+	return buf
+}
+
+// Return names and excluded names of a snapshot
+// Suffix and full tables refer to `data' directly, thus it must not be modified afterwards
+func decodeSnapshot(data []byte) (*domainSet, *domainSet, error) {
+	if len(data) < len(snapshotMagic)+8 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, nil, errors.New("not a snapshot")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, nil, errors.New("snapshot checksum mismatch, possibly truncated")
+	}
+	if v := binary.LittleEndian.Uint32(body[len(snapshotMagic):]); v != snapshotVersion {
+		return nil, nil, errors.New(fmt.Sprintf("unsupported snapshot version %v", v))
+	}
+
+	p := body[len(snapshotMagic)+4:]
+	var sets [2]*domainSet
+	for i := range sets {
+		d := newDomainSet()
+		var tables [6]*nameTable
+		for j := range tables {
+			t, rest, err := decodeNameTable(p, j < 2)
+			if err != nil {
+				return nil, nil, err
+			}
+			tables[j] = t
+			p = rest
+		}
+		d.suffixTable = tables[0]
+		d.fullTable = tables[1]
+		for _, f := range []struct {
+			t   *nameTable
+			add func(string) bool
+		}{
+			{tables[2], d.addKeyword},
+			{tables[3], d.addGlob},
+			{tables[4], d.addRegexp},
+			{tables[5], d.addCidr},
+		} {
+			for k := 0; k < f.t.Len(); k++ {
+				if !f.add(string(f.t.at(k))) {
+					return nil, nil, errors.New(fmt.Sprintf("bad rule %q in snapshot", f.t.at(k)))
+				}
+			}
+		}
+		sets[i] = d
+	}
+	if len(p) != 0 {
+		return nil, nil, errors.New("trailing garbage in snapshot")
+	}
+	return sets[0], sets[1], nil
+}
+
+func decodeNameTable(p []byte, sorted bool) (*nameTable, []byte, error) {
+	malformed := errors.New("malformed snapshot")
+	if len(p) < 4 {
+		return nil, nil, malformed
+	}
+	n := uint64(binary.LittleEndian.Uint32(p))
+	p = p[4:]
+	if uint64(len(p)) < (n+1)*4 {
+		return nil, nil, malformed
+	}
+	t := &nameTable{offsets: p[:(n+1)*4]}
+	p = p[(n+1)*4:]
+	size := t.offset(int(n))
+	if uint64(len(p)) < uint64(size) || t.offset(0) != 0 {
+		return nil, nil, malformed
+	}
+	t.blob = p[:size]
+	for i := 0; i < int(n); i++ {
+		if t.offset(i) > t.offset(i+1) {
+			return nil, nil, malformed
+		}
+		// Binary search relies on strictly ascending order
+		if sorted && i > 0 && string(t.at(i-1)) >= string(t.at(i)) {
+			return nil, nil, errors.New("snapshot table not sorted")
+		}
+	}
+	return t, p[size:], nil
+}
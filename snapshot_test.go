@@ -0,0 +1,91 @@
+package dnsredir
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.conf")
+	content := "example.com\nserver=/example.net/114.114.114.114\nfull:a.example.org\nkeyword:ads\n*.cdn.example.io\nregexp:^x+\\.dev$\ncidr:10.0.0.0/8\n!sub.example.com\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := CompileSnapshot(&buf, []string{path}); err != nil {
+		t.Fatalf("CompileSnapshot() failed: %v", err)
+	}
+	data := buf.Bytes()
+
+	n := &NameList{}
+	item := &NameItem{whichType: NameItemTypePath, format: nameFormatAuto}
+	res, err := n.parse(bytes.NewReader(data), item)
+	if err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	n.items = []*NameItem{item}
+	item.names = res.names
+	item.excluded = res.excluded
+
+	tests := []struct {
+		name    string
+		matched bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"sub.example.com", false},
+		{"www.sub.example.com", false},
+		{"example.net", true},
+		{"a.example.org", true},
+		{"b.a.example.org", false},
+		{"example.org", false},
+		{"ads.example.de", true},
+		{"img.cdn.example.io", true},
+		{"cdn.example.io", false},
+		{"xxx.dev", true},
+		{"y.dev", false},
+		{"com", false},
+		{"1.0.0.10.in-addr.arpa", true},
+		{"1.0.0.11.in-addr.arpa", false},
+	}
+	for i, test := range tests {
+		if n.Match(test.name) != test.matched {
+			t.Errorf("Test case#%v failed, Match(%q) expected %v", i, test.name, test.matched)
+		}
+	}
+	if l := res.names.Len(); l != 7 {
+		t.Errorf("Expected 7 rules, got %v: %v", l, res.names)
+	}
+
+	// Corrupted and truncated snapshots are rejected
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	for i, bad := range [][]byte{corrupted, data[:len(data)-1], data[:len(snapshotMagic)]} {
+		if _, _, err := decodeSnapshot(bad); err == nil {
+			t.Errorf("Bad snapshot#%v accepted", i)
+		}
+	}
+}
+
+func BenchmarkSnapshotLoad(b *testing.B) {
+	var buf bytes.Buffer
+	d := newDomainSet()
+	for _, line := range strings.Split(genDnsmasqConf(100000), "\n") {
+		if s := strings.Split(line, "/"); len(s) > 1 {
+			d.Add(s[1])
+		}
+	}
+	if err := encodeSnapshot(&buf, d, newDomainSet()); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := decodeSnapshot(buf.Bytes()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
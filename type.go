@@ -17,6 +17,18 @@ const (
 	typeTotalCount // Dummy type
 )
 
+func (t transportType) String() string {
+	switch t {
+	case typeUdp:
+		return "udp"
+	case typeTcp:
+		return "tcp"
+	case typeTls:
+		return "tcp-tls"
+	}
+	return fmt.Sprintf("%T(%d)", t, int(t))
+}
+
 func stringToTransportType(s string) transportType {
 	switch s {
 	case "udp":
@@ -13,28 +13,62 @@ import (
 	"github.com/coredns/coredns/plugin"
 	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
 	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type reloadableUpstream struct {
+	// Block identity used to hand over states across Corefile reloads
+	key string
 	// Flag indicate match any request, i.e. the root zone "."
 	matchAny bool
+	from     []string
 	*NameList
-	inline  domainSet
-	ignored domainSet
+	inline  *domainSet
+	ignored *domainSet
+	// Name list loaded from except FILE|URL..., names in it are excepted
+	exceptList *NameList
+	// Options of FROM and except URLs, keyed by URL
+	urlOptions map[string]*urlOptions
+	// Conditions other than the query name, see: condition.go
+	cond requestCondition
 	*HealthCheck
+	// Upstream group queried along with `to TO...', nil if not specified, see: foreign TO...
+	foreign *HealthCheck
+	// Replies of `to TO...' are accepted only if their addresses are within it, see: domestic_ip
+	domesticIP *ipList
+	// Replies with addresses in it are rewritten to NXDOMAIN, see: bogus_nxdomain
+	bogusNxdomain *ipList
+	// Replies with addresses in it are rejected, the exchange is retried, see: reject_answer_ip
+	rejectAnswerIP *ipList
+	// Response cache, nil if not enabled, see: cache.go
+	cache *replyCache
+	// Identical requests in flight, which share a single exchange
+	inflight singleflight.Group
+	// Generation of name lists, increased on any change, see: matchIndex
+	indexGen atomic.Uint64
 	// Bootstrap DNS in IP:Port combo
 	bootstrap []string
 	ipset     interface{}
 	pf        interface{}
 	noIPv6    bool
 	maxRetry  int32
+	// Plugin-level flag, see: Dnsredir.longestMatch
+	longestMatch bool
+	// Route names to upstreams specified in dnsmasq server=/DOMAIN/UPSTREAM lines
+	dnsmasqUpstream bool
+	// Server address, used as label of metrics
+	server string
+	// Arguments of the tls property, used to tell if transport settings changed
+	tlsArgs []string
 }
 
 // reloadableUpstream implements Upstream interface
@@ -47,7 +81,7 @@ func (u *reloadableUpstream) Match(name string) bool {
 			panic(fmt.Sprintf("Why %q doesn't match %q?!", name, "."))
 		}
 
-		ignored := u.ignored.Match(name)
+		ignored := u.isExcepted(name)
 		if ignored {
 			log.Debugf("#0 Skip %q since it's ignored", name)
 		}
@@ -58,16 +92,129 @@ func (u *reloadableUpstream) Match(name string) bool {
 		return false
 	}
 
-	if u.ignored.Match(name) {
+	if u.isExcepted(name) {
 		log.Debugf("#1 Skip %q since it's ignored", name)
 		return false
 	}
 	return true
 }
 
+// Check if conditions other than the query name are satisfied by the request
+func (u *reloadableUpstream) Accept(state *request.Request) bool {
+	return u.cond.accept(state)
+}
+
+// Check if given name is excepted by `except NAME|FILE|URL...'
+func (u *reloadableUpstream) isExcepted(name string) bool {
+	return u.ignored.Match(name) || u.exceptList.Match(name)
+}
+
+// Check if `suffix' is exactly listed in, or excepted from the upstream name list
+// `suffix' is lower cased and without trailing dot, `whole' denotes if it's the query name itself
+func (u *reloadableUpstream) Lookup(suffix string, whole bool) (bool, bool) {
+	if u.ignored.Lookup(suffix, whole) {
+		return false, true
+	}
+	if excepted, _ := u.exceptList.Lookup(suffix, whole); excepted {
+		return false, true
+	}
+	if u.matchAny {
+		return false, false
+	}
+	listed, excluded := u.NameList.Lookup(suffix, whole)
+	if excluded {
+		return false, true
+	}
+	return listed || u.inline.Lookup(suffix, whole), false
+}
+
+// Iterate over all domain sets which Lookup() consults
+func (u *reloadableUpstream) forEachDomainSet(f func(d *domainSet)) {
+	f(u.inline)
+	f(u.ignored)
+	u.NameList.forEachDomainSet(f)
+	u.exceptList.forEachDomainSet(f)
+}
+
+// Select an upstream host for `name', upstream specified in name list takes precedence over `to TO...'
+// `name' is lower cased and without trailing dot
+func (u *reloadableUpstream) SelectFor(name string) *UpstreamHost {
+	if u.dnsmasqUpstream {
+		if upstream := u.NameList.MatchUpstream(name); len(upstream) != 0 {
+			u.entryLock.RLock()
+			host := u.entryHosts[upstream]
+			u.entryLock.RUnlock()
+			if host != nil && !host.Down() {
+				return host
+			}
+			log.Debugf("Upstream %v of %q isn't available, fallback to %q", upstream, name, "to")
+		}
+	}
+	return u.Select()
+}
+
+// Create hosts for new upstreams in name list, and discard hosts no longer referenced
+func (u *reloadableUpstream) syncEntryHosts() {
+	upstreams := u.NameList.Upstreams()
+
+	u.entryLock.Lock()
+	defer u.entryLock.Unlock()
+	select {
+	case <-u.HealthCheck.stop:
+		// Late name list update after shutdown
+		return
+	default:
+	}
+	if u.entryHosts == nil {
+		u.entryHosts = make(map[string]*UpstreamHost)
+	}
+	for upstream := range upstreams {
+		if _, found := u.entryHosts[upstream]; found {
+			continue
+		}
+		trans, addr := SplitTransportHost(upstream)
+		host := &UpstreamHost{
+			proto:    trans,
+			addr:     addr,
+			downFunc: checkDownFunc(u),
+		}
+		if err := u.initHost(host); err != nil {
+			log.Warningf("Cannot initialize upstream %v: %v", upstream, err)
+			continue
+		}
+		host.transport.Start()
+		if u.checkInterval != 0 {
+			go host.Check()
+		}
+		u.entryHosts[upstream] = host
+		log.Infof("Upstream from name list: %v", host)
+	}
+	for upstream, host := range u.entryHosts {
+		if upstreams.Contains(upstream) {
+			continue
+		}
+		delete(u.entryHosts, upstream)
+		// Queries in flight may still use this host
+		time.AfterFunc(defaultTimeout, host.transport.Stop)
+		log.Infof("Upstream %v no longer in name list", host.Name())
+	}
+}
+
 func (u *reloadableUpstream) Start() error {
+	u.takeOver()
 	u.periodicUpdate(u.bootstrap)
+	u.exceptList.periodicUpdate(u.bootstrap)
+	if u.dnsmasqUpstream {
+		// In case of name items taken over from previous instance
+		u.syncEntryHosts()
+	}
+	for _, l := range u.ipLists() {
+		l.list.periodicUpdate(u.bootstrap)
+	}
 	u.HealthCheck.Start()
+	if u.foreign != nil {
+		u.foreign.Start()
+	}
 	if err := ipsetSetup(u); err != nil {
 		return err
 	}
@@ -78,9 +225,22 @@ func (u *reloadableUpstream) Start() error {
 }
 
 func (u *reloadableUpstream) Stop() error {
+	u.giveUp()
 	close(u.stopPathReload)
 	close(u.stopUrlReload)
+	close(u.exceptList.stopPathReload)
+	close(u.exceptList.stopUrlReload)
+	u.NameList.releaseItems()
+	u.exceptList.releaseItems()
+	for _, l := range u.ipLists() {
+		close(l.list.stopPathReload)
+		close(l.list.stopUrlReload)
+		l.list.releaseItems()
+	}
 	u.HealthCheck.Stop()
+	if u.foreign != nil {
+		u.foreign.Stop()
+	}
 	if err := ipsetShutdown(u); err != nil {
 		return err
 	}
@@ -90,15 +250,76 @@ func (u *reloadableUpstream) Stop() error {
 	return nil
 }
 
+// IP lists of domestic_ip, bogus_nxdomain and reject_answer_ip
+func (u *reloadableUpstream) ipLists() []*ipList {
+	return []*ipList{u.domesticIP, u.bogusNxdomain, u.rejectAnswerIP}
+}
+
+// Initialize a parsed upstream host with transport settings of the upstream
+func (u *reloadableUpstream) initHost(host *UpstreamHost) error {
+	addr, tlsServerName := SplitByByte(host.addr, '@')
+	host.addr = addr
+	host.server = u.server
+
+	host.transport = newTransport()
+	// Inherit from global transport settings
+	host.transport.recursionDesired = u.transport.recursionDesired
+	host.transport.expire = u.transport.expire
+	if host.proto == transport.TLS {
+		// Deep copy
+		host.transport.tlsConfig = new(tls.Config)
+		host.transport.tlsConfig.Certificates = u.transport.tlsConfig.Certificates
+		host.transport.tlsConfig.RootCAs = u.transport.tlsConfig.RootCAs
+		// Don't set TLS server name if addr host part is already a domain name
+		if hostPortIsIpPort(addr) {
+			host.transport.tlsConfig.ServerName = u.transport.tlsConfig.ServerName
+		}
+
+		// TLS server name in tls:// takes precedence over the global one(if any)
+		if len(tlsServerName) != 0 {
+			tlsServerName = tlsServerName[1:]
+			serverName, ok := stringToDomain(tlsServerName)
+			if !ok {
+				return fmt.Errorf("invalid TLS server name %q", tlsServerName)
+			}
+			host.transport.tlsConfig.ServerName = serverName
+		}
+	}
+
+	network := protoToNetwork(host.proto)
+	if network == "dns" {
+		// Use classic DNS protocol for health checking
+		network = "udp"
+	}
+	host.c = &dns.Client{
+		Net:       network,
+		TLSConfig: host.transport.tlsConfig,
+		Timeout:   defaultHcTimeout,
+	}
+	host.InitDOH(u)
+	host.transport.server = u.server
+	host.transport.to = host.Name()
+	host.identity = hostIdentity(u, host)
+	return nil
+}
+
 // Parses Caddy config input and return a list of reloadable upstream for this plugin
 func NewReloadableUpstreams(c *caddy.Controller) ([]Upstream, error) {
 	var ups []Upstream
 
+	// Number of blocks seen so far with the same identity
+	seen := make(map[string]int)
 	for c.Next() {
 		u, err := newReloadableUpstream(c)
 		if err != nil {
 			return nil, err
 		}
+		r := u.(*reloadableUpstream)
+		r.key = blockKey(c, r)
+		seen[r.key]++
+		if n := seen[r.key]; n > 1 {
+			r.key += "#" + strconv.Itoa(n)
+		}
 		ups = append(ups, u)
 	}
 
@@ -108,6 +329,21 @@ func NewReloadableUpstreams(c *caddy.Controller) ([]Upstream, error) {
 	return ups, nil
 }
 
+// Return server address in the same format as metrics.WithServer(), e.g. dns://:53
+// see: coredns/core/dnsserver/register.go#groupConfigsByListenAddr()
+func serverAddr(c *caddy.Controller) string {
+	config := dnsserver.GetConfig(c)
+	var host string
+	if len(config.ListenHosts) != 0 {
+		host = config.ListenHosts[0]
+	}
+	addr := net.JoinHostPort(host, config.Port)
+	if a, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		addr = a.String()
+	}
+	return config.Transport + "://" + addr
+}
+
 // see: healthcheck.go/UpstreamHost.Dial()
 func protoToNetwork(proto string) string {
 	if proto == "tls" {
@@ -125,8 +361,12 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 			urlReadTimeout: defaultUrlReadTimeout,
 			stopUrlReload:  make(chan struct{}),
 		},
-		ignored:  make(domainSet),
-		inline:   make(domainSet),
+		ignored: newDomainSet(),
+		exceptList: &NameList{
+			stopPathReload: make(chan struct{}),
+			stopUrlReload:  make(chan struct{}),
+		},
+		inline:   newDomainSet(),
 		maxRetry: defaultMaxRetry,
 		HealthCheck: &HealthCheck{
 			stop:          make(chan struct{}),
@@ -138,6 +378,10 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 				recursionDesired: true,
 			},
 		},
+		domesticIP:     newIPList(),
+		bogusNxdomain:  newIPList(),
+		rejectAnswerIP: newIPList(),
+		cache:          newReplyCache(),
 	}
 
 	if err := parseFrom(c, u); err != nil {
@@ -153,46 +397,57 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 	if u.hosts == nil {
 		return nil, c.Errf("missing mandatory property: %q", "to")
 	}
+	u.server = serverAddr(c)
+	u.NameList.server = u.server
+	// except FILE|URL... shares the same reload settings with FROM..., so do IP lists
+	u.exceptList.inheritReload(u.NameList)
+	for _, l := range u.ipLists() {
+		l.list.inheritReload(u.NameList)
+	}
+	if err := u.attachUrlOptions(); err != nil {
+		return nil, c.Err(err.Error())
+	}
 	for _, host := range u.hosts {
-		addr, tlsServerName := SplitByByte(host.addr, '@')
-		host.addr = addr
-
-		host.transport = newTransport()
-		// Inherit from global transport settings
-		host.transport.recursionDesired = u.transport.recursionDesired
-		host.transport.expire = u.transport.expire
-		if host.proto == transport.TLS {
-			// Deep copy
-			host.transport.tlsConfig = new(tls.Config)
-			host.transport.tlsConfig.Certificates = u.transport.tlsConfig.Certificates
-			host.transport.tlsConfig.RootCAs = u.transport.tlsConfig.RootCAs
-			// Don't set TLS server name if addr host part is already a domain name
-			if hostPortIsIpPort(addr) {
-				host.transport.tlsConfig.ServerName = u.transport.tlsConfig.ServerName
-			}
+		if err := u.initHost(host); err != nil {
+			return nil, c.Err(err.Error())
+		}
+	}
 
-			// TLS server name in tls:// takes precedence over the global one(if any)
-			if len(tlsServerName) != 0 {
-				tlsServerName = tlsServerName[1:]
-				serverName, ok := stringToDomain(tlsServerName)
-				if !ok {
-					return nil, c.Errf("invalid TLS server name %q", tlsServerName)
-				}
-				host.transport.tlsConfig.ServerName = serverName
+	if u.foreign != nil {
+		if u.domesticIP.args == nil {
+			return nil, c.Errf("%q requires %q", "foreign", "domestic_ip")
+		}
+		// Foreign group shares the same health check and selection settings with `to TO...'
+		u.foreign.policy = u.policy
+		u.foreign.spray = u.spray
+		u.foreign.maxFails = u.maxFails
+		u.foreign.checkInterval = u.checkInterval
+		u.foreign.transport = u.transport
+		for _, host := range u.foreign.hosts {
+			if err := u.initHost(host); err != nil {
+				return nil, c.Err(err.Error())
 			}
 		}
+	} else if u.domesticIP.args != nil {
+		return nil, c.Errf("%q requires %q", "domestic_ip", "foreign")
+	}
 
-		network := protoToNetwork(host.proto)
-		if network == "dns" {
-			// Use classic DNS protocol for health checking
-			network = "udp"
+	if u.cache.capacity != 0 {
+		if u.cache.minTTL > u.cache.maxTTL {
+			return nil, c.Errf("%v %v is greater than %v %v", "min_ttl", u.cache.minTTL, "max_ttl", u.cache.maxTTL)
 		}
-		host.c = &dns.Client{
-			Net:       network,
-			TLSConfig: host.transport.tlsConfig,
-			Timeout:   defaultHcTimeout,
+		u.cache.init()
+	} else if u.cache.configured {
+		return nil, c.Errf("%q, %q, %q and %q require %q", "min_ttl", "max_ttl", "prefetch", "serve_stale", "cache")
+	} else {
+		u.cache = nil
+	}
+
+	if u.dnsmasqUpstream {
+		if u.matchAny {
+			log.Warningf("%v is useless since %q will match all requests", "dnsmasq_upstream", ".")
 		}
-		host.InitDOH(u)
+		u.NameList.onUpdate = u.syncEntryHosts
 	}
 
 	if err := u.inline.ForEachDomain(func(name string) error {
@@ -218,26 +473,7 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 			u.urlReload = 0
 		}
 	} else {
-		hasPath := false
-		hasUrl := false
-		for _, item := range u.NameList.items {
-			switch item.whichType {
-			case NameItemTypePath:
-				hasPath = true
-			case NameItemTypeUrl:
-				hasUrl = true
-			default:
-				panic(fmt.Sprintf("Unexpected NameItem type %v", item.whichType))
-			}
-		}
-		if !hasPath {
-			log.Debugf("Reset path_reload %v to zero since no path found", u.pathReload)
-			u.NameList.pathReload = 0
-		}
-		if !hasUrl {
-			log.Debugf("Reset url_reload %v to zero since no url found", u.urlReload)
-			u.NameList.urlReload = 0
-		}
+		u.NameList.resetReload()
 	}
 
 	if u.inline.Len() != 0 {
@@ -253,6 +489,7 @@ func parseFrom(c *caddy.Controller, u *reloadableUpstream) error {
 	if n == 0 {
 		return c.ArgErr()
 	}
+	u.from = forms
 
 	if n == 1 && forms[0] == "." {
 		u.matchAny = true
@@ -260,37 +497,125 @@ func parseFrom(c *caddy.Controller, u *reloadableUpstream) error {
 		return nil
 	}
 
-	config := dnsserver.GetConfig(c)
+	var sources []string
 	for _, from := range forms {
-		if strings.Index(from, "://") > 0 {
+		// Reverse DNS names within the CIDR, kept along with INLINE names
+		if strings.HasPrefix(from, rulePrefixCidr) {
+			if !u.inline.Add(from) {
+				return c.Errf("bad CIDR %q", from)
+			}
 			continue
 		}
+		if err := checkNamePath(c, from); err != nil {
+			return err
+		}
+		sources = append(sources, from)
+	}
 
-		if !filepath.IsAbs(from) && config.Root != "" {
-			from = filepath.Join(config.Root, from)
+	items, err := NewNameItemsWithForms(sources)
+	if err != nil {
+		return err
+	}
+	u.addItems(items)
+	log.Infof("FROM...: %v", forms)
+	return nil
+}
+
+// Attach url_option to URL name items of FROM..., except and IP lists
+func (u *reloadableUpstream) attachUrlOptions() error {
+	used := make(map[string]bool)
+	lists := []*NameList{u.NameList, u.exceptList}
+	for _, l := range u.ipLists() {
+		lists = append(lists, l.list)
+	}
+	for _, n := range lists {
+		for _, item := range n.snapshot() {
+			if item.whichType != NameItemTypeUrl {
+				continue
+			}
+			if options, ok := u.urlOptions[item.url]; ok {
+				item.options = options
+				used[item.url] = true
+			}
+		}
+	}
+	for theUrl := range u.urlOptions {
+		if !used[theUrl] {
+			return errors.New(fmt.Sprintf("url_option: %q isn't an URL of FROM..., except or IP lists", theUrl))
 		}
+	}
+	return nil
+}
 
-		st, err := os.Stat(from)
+// Check existence of a FROM path, URL is skipped
+func checkNamePath(c *caddy.Controller, from string) error {
+	_, from, _ = splitCategory(splitFormat(from))
+	if strings.Index(from, "://") > 0 {
+		return nil
+	}
+
+	config := dnsserver.GetConfig(c)
+	if !filepath.IsAbs(from) && config.Root != "" {
+		from = filepath.Join(config.Root, from)
+	}
+
+	if strings.ContainsAny(from, "*?[") {
+		matches, err := filepath.Glob(from)
 		if err != nil {
-			if os.IsNotExist(err) {
-				log.Warningf("File %q doesn't exist", from)
-			} else {
-				return err
-			}
-		} else if st != nil && !st.Mode().IsRegular() {
-			log.Warningf("File %q isn't a regular file", from)
+			return c.Errf("bad glob pattern %q: %v", from, err)
+		}
+		if len(matches) == 0 {
+			log.Warningf("No file matches %q", from)
 		}
+		return nil
 	}
 
-	items, err := NewNameItemsWithForms(forms)
+	st, err := os.Stat(from)
 	if err != nil {
-		return err
+		if os.IsNotExist(err) {
+			log.Warningf("File %q doesn't exist", from)
+		} else {
+			return err
+		}
+	} else if st != nil && !st.Mode().IsRegular() && !st.IsDir() {
+		log.Warningf("File %q isn't a regular file", from)
 	}
-	u.items = items
-	log.Infof("FROM...: %v", forms)
 	return nil
 }
 
+// Check if an except argument is a FILE or URL rather than a domain name
+func isNameSource(c *caddy.Controller, arg string) bool {
+	for _, prefix := range []string{rulePrefixDomain, rulePrefixFull, rulePrefixKeyword, rulePrefixRegexp, rulePrefixCidr} {
+		if strings.HasPrefix(arg, prefix) {
+			return false
+		}
+	}
+	if format, _ := splitFormat(arg); format != nameFormatAuto || strings.ContainsRune(arg, '/') {
+		return true
+	}
+
+	config := dnsserver.GetConfig(c)
+	if config.Root != "" {
+		arg = filepath.Join(config.Root, arg)
+	}
+	_, err := os.Stat(arg)
+	return err == nil
+}
+
+// Extensions of list files, none of them is a top-level domain
+var listFileExts = []string{".conf", ".txt", ".list", ".hosts", ".yaml", ".yml", ".json", ".dat", ".rules"}
+
+// Check if a bare except argument ends with a list file extension
+func looksLikeFileName(arg string) bool {
+	ext := strings.ToLower(filepath.Ext(arg))
+	for _, e := range listFileExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
 func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 	switch dir := c.Val(); dir {
 	case "path_reload":
@@ -328,6 +653,57 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		}
 		u.urlReload = dur
 		log.Infof("%v: %v %v", dir, u.urlReload, u.urlReadTimeout)
+	case "max_shrink", "max_invalid":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		percent, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+		if err != nil || percent < 0 || percent > 100 {
+			return c.Errf("%v: %q isn't a valid percentage", dir, args[0])
+		}
+		if dir == "max_shrink" {
+			u.maxShrink = percent
+		} else {
+			u.maxInvalid = percent
+		}
+		log.Infof("%v: %v%%", dir, percent)
+	case "url_option":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		// Options of the same URL are merged together
+		_, theUrl, _ := splitCategory(splitFormat(args[0]))
+		theUrl, _, _, err := splitReloadParams(theUrl)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		if u.urlOptions == nil {
+			u.urlOptions = make(map[string]*urlOptions)
+		}
+		if u.urlOptions[theUrl] == nil {
+			u.urlOptions[theUrl] = &urlOptions{}
+		}
+		if err := u.urlOptions[theUrl].parse(args[1], args[2:]); err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		log.Infof("%v: %v", dir, args)
+	case "url_cache":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		cacheDir := args[0]
+		config := dnsserver.GetConfig(c)
+		if !filepath.IsAbs(cacheDir) && config.Root != "" {
+			cacheDir = filepath.Join(config.Root, cacheDir)
+		}
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.urlCache = cacheDir
+		log.Infof("%v: %v", dir, u.urlCache)
 	case "except":
 		// Multiple "except"s will be merged together
 		args := c.RemainingArgs()
@@ -335,6 +711,22 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 			return c.ArgErr()
 		}
 		for _, name := range args {
+			if isNameSource(c, name) {
+				if err := checkNamePath(c, name); err != nil {
+					return err
+				}
+				items, err := NewNameItemsWithForms([]string{name})
+				if err != nil {
+					return err
+				}
+				u.exceptList.addItems(items)
+				log.Infof("%v: %v", dir, name)
+				continue
+			}
+			if looksLikeFileName(name) {
+				// Most likely a list file which doesn't exist yet, rather than a domain
+				return c.Errf("%v: %q doesn't exist, use %q if it's a file", dir, name, "./"+name)
+			}
 			if !u.ignored.Add(name) {
 				log.Warningf("%q isn't a domain name", name)
 			}
@@ -392,7 +784,31 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		log.Infof("%v: %v %v", dir, u.checkInterval, u.transport.recursionDesired)
 	case "to":
 		// Multiple "to"s will be merged together
-		if err := parseTo(c, u); err != nil {
+		hosts, err := parseTo(c, u)
+		if err != nil {
+			return err
+		}
+		u.hosts = append(u.hosts, hosts...)
+	case "foreign":
+		// So do multiple "foreign"s
+		hosts, err := parseTo(c, u)
+		if err != nil {
+			return err
+		}
+		if u.foreign == nil {
+			u.foreign = &HealthCheck{stop: make(chan struct{})}
+		}
+		u.foreign.hosts = append(u.foreign.hosts, hosts...)
+	case "domestic_ip":
+		if err := u.domesticIP.parse(c); err != nil {
+			return err
+		}
+	case "bogus_nxdomain":
+		if err := u.bogusNxdomain.parse(c); err != nil {
+			return err
+		}
+	case "reject_answer_ip":
+		if err := u.rejectAnswerIP.parse(c); err != nil {
 			return err
 		}
 	case "expire":
@@ -417,6 +833,7 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		// Merge server name if tls_servername set previously
 		tlsConfig.ServerName = u.transport.tlsConfig.ServerName
 		u.transport.tlsConfig = tlsConfig
+		u.tlsArgs = args
 		log.Infof("%v: %v", dir, args)
 	case "tls_servername":
 		args := c.RemainingArgs()
@@ -441,6 +858,92 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		if err := pfParse(c, u); err != nil {
 			return err
 		}
+	case "dnsmasq_upstream":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.dnsmasqUpstream = true
+		u.NameList.dnsmasqUpstream = true
+		log.Infof("%v: enabled", dir)
+	case "qtype", "not_qtype", "qclass", "opcode", "from_client", "not_from_client", "trusted_ecs":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		if err := u.cond.parse(dir, args); err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		log.Infof("%v: %v", dir, args)
+	case "cache":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		u.cache.capacity = defaultCacheCapacity
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return c.Errf("%v: %q isn't a positive integer", dir, args[0])
+			}
+			u.cache.capacity = n
+		}
+		log.Infof("%v: %v", dir, u.cache.capacity)
+	case "min_ttl", "max_ttl":
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dir == "min_ttl" {
+			u.cache.minTTL = dur
+		} else {
+			if dur < minCacheMaxTTL {
+				return c.Errf("%v: minimal TTL is %v", dir, minCacheMaxTTL)
+			}
+			u.cache.maxTTL = dur
+		}
+		u.cache.configured = true
+		log.Infof("%v: %v", dir, dur)
+	case "prefetch":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return c.Errf("%v: %q isn't a positive integer", dir, args[0])
+		}
+		if len(args) == 2 {
+			percent, err := strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+			if err != nil || percent <= 0 || percent > 100 {
+				return c.Errf("%v: %q isn't a valid percentage", dir, args[1])
+			}
+			u.cache.prefetchPercent = percent
+		}
+		u.cache.prefetch = n
+		u.cache.configured = true
+		log.Infof("%v: %v %v%%", dir, n, u.cache.prefetchPercent)
+	case "serve_stale":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		dur := defaultServeStale
+		if len(args) == 1 {
+			d, err := parseDuration0(dir, args[0])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			dur = d
+		}
+		u.cache.serveStale = dur
+		u.cache.configured = true
+		log.Infof("%v: %v", dir, dur)
+	case "longest_match":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.longestMatch = true
+		log.Infof("%v: enabled", dir)
 	case "no_ipv6":
 		args := c.RemainingArgs()
 		if len(args) != 0 {
@@ -507,17 +1010,20 @@ func parseDuration(c *caddy.Controller) (time.Duration, error) {
 	return dur, c.Err(err.Error())
 }
 
-func parseTo(c *caddy.Controller, u *reloadableUpstream) error {
+// Parse hosts of `to TO...' or `foreign TO...'
+func parseTo(c *caddy.Controller, u *reloadableUpstream) ([]*UpstreamHost, error) {
 	args := c.RemainingArgs()
 	if len(args) == 0 {
-		return c.ArgErr()
+		return nil, c.ArgErr()
 	}
 
 	toHosts, err := HostPort(args)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var hosts []*UpstreamHost
+
 	for _, host := range toHosts {
 		trans, addr := SplitTransportHost(host)
 		log.Infof("Transport: %v Address: %v", trans, addr)
@@ -528,12 +1034,12 @@ func parseTo(c *caddy.Controller, u *reloadableUpstream) error {
 			addr:     addr,
 			downFunc: checkDownFunc(u),
 		}
-		u.hosts = append(u.hosts, uh)
+		hosts = append(hosts, uh)
 
 		log.Infof("Upstream: %v", uh)
 	}
 
-	return nil
+	return hosts, nil
 }
 
 func parseBootstrap(c *caddy.Controller, u *reloadableUpstream) error {
@@ -611,4 +1117,6 @@ const (
 
 	minHcInterval     = 1 * time.Second
 	minExpireInterval = 1 * time.Second
+
+	minCacheMaxTTL = 1 * time.Second
 )
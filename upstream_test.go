@@ -0,0 +1,64 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/coredns/caddy"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExceptList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "except.conf")
+	if err := os.WriteFile(path, []byte("foo.example.com\nbar.example.com\n!www.bar.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	input := fmt.Sprintf("dnsredir . {\n to 1.1.1.1 \n except %v baz.example.com https://example.com/except.conf \n}", path)
+	c := caddy.NewTestController("dns", input)
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatalf("NewReloadableUpstreams() failed: %v", err)
+	}
+	u := ups[0].(*reloadableUpstream)
+	if n := len(u.exceptList.items); n != 2 {
+		t.Fatalf("Expected 2 except items, got %v", n)
+	}
+	if u.ignored.Len() != 1 || u.exceptList.pathReload == 0 || u.exceptList.urlReload == 0 {
+		t.Fatalf("Unexpected except settings, ignored: %v, reload: %v %v",
+			u.ignored, u.exceptList.pathReload, u.exceptList.urlReload)
+	}
+	u.exceptList.updateItemFromPath(u.exceptList.items[0])
+
+	tests := []struct {
+		name    string
+		matched bool
+	}{
+		{"example.com", true},
+		{"foo.example.com", false},
+		{"a.foo.example.com", false},
+		{"bar.example.com", false},
+		{"www.bar.example.com", true},
+		{"baz.example.com", false},
+	}
+	for i, test := range tests {
+		if matched := u.Match(test.name); matched != test.matched {
+			t.Errorf("Test case#%v failed, %q matched: %v, expected: %v", i, test.name, matched, test.matched)
+		}
+	}
+}
+
+func TestExceptFileName(t *testing.T) {
+	tests := []testCase{
+		{"dnsredir . {\n to 1.1.1.1\n except corp-except.conf\n}", true, "doesn't exist"},
+		{"dnsredir . {\n to 1.1.1.1\n except ./corp-except.conf\n}", false, ""},
+		{"dnsredir . {\n to 1.1.1.1\n except example.com example.co\n}", false, ""},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := newReloadableUpstream(c)
+		if !test.Pass(err) {
+			t.Errorf("Test#%v failed  %v vs err: %v", i, test, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Last good copy of an URL name item, so it can be loaded before network(and DNS) is available
+// The cache file is the JSON encoded header line followed by the content
+type urlCacheHeader struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Checksum or signature the content verified against, and where it's fetched, see: url_option verify
+	// Proof is raw bytes(e.g. a binary signature), thus base64 encoded in JSON
+	ProofUrl string `json:"proof_url,omitempty"`
+	Proof    []byte `json:"proof,omitempty"`
+}
+
+func urlCachePath(dir, theUrl string) string {
+	sum := sha256.Sum256([]byte(theUrl))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16])+".cache")
+}
+
+func loadUrlCache(dir, theUrl string) (*urlCacheHeader, string, error) {
+	file, err := os.Open(urlCachePath(dir, theUrl))
+	if err != nil {
+		return nil, "", err
+	}
+	defer Close(file)
+
+	br := bufio.NewReader(file)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, "", err
+	}
+	header := &urlCacheHeader{}
+	if err := json.Unmarshal([]byte(line), header); err != nil {
+		return nil, "", err
+	}
+	if header.Url != theUrl {
+		return nil, "", errors.New(fmt.Sprintf("URL mismatch, expected %q, got %q", theUrl, header.Url))
+	}
+
+	var sb strings.Builder
+	if _, err := io.Copy(&sb, br); err != nil {
+		return nil, "", err
+	}
+	return header, sb.String(), nil
+}
+
+// The cache file is replaced atomically
+func storeUrlCache(dir string, header *urlCacheHeader, content string) error {
+	line, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, ".url-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	_, err = file.Write(append(line, '\n'))
+	if err == nil {
+		_, err = file.WriteString(content)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp, urlCachePath(dir, header.Url))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
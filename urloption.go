@@ -0,0 +1,448 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Per-URL options of FROM and except URLs, see: url_option
+type urlOptions struct {
+	// Content is verified before swapped in, nil to disable
+	verifier *urlVerifier
+
+	bearer        *secret
+	basicUser     string
+	basicPassword *secret
+	header        http.Header
+
+	// Custom CA bundle and/or client certificate, nil to use system defaults
+	tlsConfig *tls.Config
+	// nil to use proxy from environment variables
+	proxy *url.URL
+	// Maximum size of the response body(after decoded), zero means unlimited
+	maxSize int64
+
+	// Parsed options in their original form, used as part of name item identity
+	spec []string
+}
+
+// Parse `url_option URL KEY ARGS...'
+func (o *urlOptions) parse(key string, args []string) error {
+	o.spec = append(o.spec, strings.Join(append([]string{key}, args...), " "))
+	switch key {
+	case "sha256", "ed25519", "minisign":
+		if o.verifier != nil {
+			return errors.New("only one verification method allowed")
+		}
+		v, err := newUrlVerifier(key, args)
+		if err != nil {
+			return err
+		}
+		o.verifier = v
+	case "bearer":
+		if len(args) != 1 {
+			return errors.New("usage: bearer file:PATH|env:NAME")
+		}
+		s, err := newSecret(args[0])
+		if err != nil {
+			return err
+		}
+		o.bearer = s
+	case "basic":
+		if len(args) != 2 {
+			return errors.New("usage: basic USER file:PATH|env:NAME")
+		}
+		s, err := newSecret(args[1])
+		if err != nil {
+			return err
+		}
+		o.basicUser = args[0]
+		o.basicPassword = s
+	case "header":
+		if len(args) < 2 {
+			return errors.New("usage: header NAME VALUE...")
+		}
+		if o.header == nil {
+			o.header = make(http.Header)
+		}
+		o.header.Add(args[0], strings.Join(args[1:], " "))
+	case "ca":
+		if len(args) != 1 {
+			return errors.New("usage: ca FILE")
+		}
+		pem, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New(fmt.Sprintf("no certificate found in %q", args[0]))
+		}
+		o.ensureTlsConfig().RootCAs = pool
+	case "cert":
+		if len(args) != 2 {
+			return errors.New("usage: cert CERT_FILE KEY_FILE")
+		}
+		cert, err := tls.LoadX509KeyPair(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		o.ensureTlsConfig().Certificates = []tls.Certificate{cert}
+	case "proxy":
+		if len(args) != 1 {
+			return errors.New("usage: proxy URL")
+		}
+		proxy, err := url.Parse(args[0])
+		if err != nil {
+			return err
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return errors.New(fmt.Sprintf("unsupported proxy %q", args[0]))
+		}
+		o.proxy = proxy
+	case "max_size":
+		if len(args) != 1 {
+			return errors.New("usage: max_size SIZE")
+		}
+		size, err := parseSize(args[0])
+		if err != nil {
+			return err
+		}
+		o.maxSize = size
+	default:
+		return errors.New(fmt.Sprintf("unknown option %q", key))
+	}
+	return nil
+}
+
+func (o *urlOptions) ensureTlsConfig() *tls.Config {
+	if o.tlsConfig == nil {
+		o.tlsConfig = &tls.Config{}
+	}
+	return o.tlsConfig
+}
+
+// Apply authorization and extra headers to the request
+// Secrets are read on each request, so they can be rotated without Corefile reloads
+func (o *urlOptions) apply(req *http.Request) error {
+	for name, values := range o.header {
+		req.Header[name] = values
+	}
+	if o.bearer != nil {
+		token, err := o.bearer.value()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if o.basicPassword != nil {
+		password, err := o.basicPassword.value()
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(o.basicUser, password)
+	}
+	return nil
+}
+
+// Check if any credential(authorization, extra headers or client certificate) is specified
+func (o *urlOptions) hasCredentials() bool {
+	return o.bearer != nil || o.basicPassword != nil || len(o.header) != 0 ||
+		(o.tlsConfig != nil && len(o.tlsConfig.Certificates) != 0)
+}
+
+// Return options for requests to other origins, i.e. without any credential
+func (o *urlOptions) withoutCredentials() *urlOptions {
+	o1 := *o
+	o1.bearer = nil
+	o1.basicUser = ""
+	o1.basicPassword = nil
+	o1.header = nil
+	if o.tlsConfig != nil && len(o.tlsConfig.Certificates) != 0 {
+		o1.tlsConfig = o.tlsConfig.Clone()
+		o1.tlsConfig.Certificates = nil
+	}
+	return &o1
+}
+
+// Check if two URLs share the same scheme and host(including port)
+func sameOrigin(u1, u2 *url.URL) bool {
+	return strings.EqualFold(u1.Scheme, u2.Scheme) && strings.EqualFold(u1.Host, u2.Host)
+}
+
+// Return options for requests to `theUrl', credentials are only sent to the origin of `origin'
+func (o *urlOptions) forUrl(origin, theUrl string) *urlOptions {
+	if o == nil {
+		return nil
+	}
+	u1, err1 := url.Parse(origin)
+	u2, err2 := url.Parse(theUrl)
+	if err1 == nil && err2 == nil && sameOrigin(u1, u2) {
+		return o
+	}
+	return o.withoutCredentials()
+}
+
+// Size in bytes, K/M/G suffixes(power of 1024) are accepted, e.g. 64M
+func parseSize(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, errors.New("empty size")
+	}
+	shift := 0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift != 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)>>shift {
+		return 0, errors.New(fmt.Sprintf("bad size %q", s))
+	}
+	return n << shift, nil
+}
+
+// Secret read from a file or an environment variable, so it won't be put in Corefile
+type secret struct {
+	file string
+	env  string
+}
+
+func newSecret(s string) (*secret, error) {
+	var sec *secret
+	switch {
+	case strings.HasPrefix(s, "file:"):
+		sec = &secret{file: s[len("file:"):]}
+	case strings.HasPrefix(s, "env:"):
+		sec = &secret{env: s[len("env:"):]}
+	default:
+		return nil, errors.New(fmt.Sprintf("secret %q must be file:PATH or env:NAME", s))
+	}
+	// Fail early
+	if _, err := sec.value(); err != nil {
+		return nil, err
+	}
+	return sec, nil
+}
+
+// Leading and trailing whitespaces(e.g. the trailing newline of a file) are trimmed
+func (s *secret) value() (string, error) {
+	var v string
+	if len(s.file) != 0 {
+		b, err := os.ReadFile(s.file)
+		if err != nil {
+			return "", err
+		}
+		v = string(b)
+	} else {
+		var ok bool
+		if v, ok = os.LookupEnv(s.env); !ok {
+			return "", errors.New(fmt.Sprintf("environment variable %q not set", s.env))
+		}
+	}
+	v = strings.TrimSpace(v)
+	if len(v) == 0 {
+		return "", errors.New("empty secret")
+	}
+	return v, nil
+}
+
+const (
+	verifySha256   = "sha256"
+	verifyEd25519  = "ed25519"
+	verifyMinisign = "minisign"
+)
+
+// Verifies URL content against a checksum or a detached signature fetched from a second URL
+type urlVerifier struct {
+	method string
+	// URL of the checksum or the signature
+	url       string
+	publicKey ed25519.PublicKey
+	// minisign key ID
+	keyId []byte
+}
+
+// Formats:
+//
+//	sha256 SUM_URL
+//	ed25519 SIG_URL PUBKEY
+//	minisign SIG_URL PUBKEY
+func newUrlVerifier(method string, args []string) (*urlVerifier, error) {
+	v := &urlVerifier{method: method}
+	switch method {
+	case verifySha256:
+		if len(args) != 1 {
+			return nil, errors.New("usage: sha256 SUM_URL")
+		}
+	case verifyEd25519:
+		if len(args) != 2 {
+			return nil, errors.New("usage: ed25519 SIG_URL PUBKEY")
+		}
+		key, err := decodeKey(args[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New(fmt.Sprintf("bad ed25519 public key %q", args[1]))
+		}
+		v.publicKey = key
+	case verifyMinisign:
+		if len(args) != 2 {
+			return nil, errors.New("usage: minisign SIG_URL PUBKEY")
+		}
+		// Signature algorithm(2 bytes) + key ID(8 bytes) + ed25519 public key
+		key, err := base64.StdEncoding.DecodeString(args[1])
+		if err != nil || len(key) != 10+ed25519.PublicKeySize || string(key[:2]) != "Ed" {
+			return nil, errors.New(fmt.Sprintf("bad minisign public key %q", args[1]))
+		}
+		v.keyId = key[2:10]
+		v.publicKey = key[10:]
+	default:
+		panic(fmt.Sprintf("Unexpected verification method %v", method))
+	}
+
+	v.url = args[0]
+	if !strings.HasPrefix(strings.ToLower(v.url), "https://") {
+		return nil, errors.New(fmt.Sprintf("%v URL %q must be https://", method, v.url))
+	}
+	return v, nil
+}
+
+// Key in either hex or base64
+func decodeKey(s string) ([]byte, error) {
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// Verify content of `theUrl', fetch() is used to get the checksum or signature
+func (v *urlVerifier) verify(theUrl, content string, fetch func(theUrl string) (string, error)) error {
+	proof, err := fetch(v.url)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot fetch %v: %v", v.url, err))
+	}
+
+	switch v.method {
+	case verifySha256:
+		return verifySha256Sum(theUrl, content, proof)
+	case verifyEd25519:
+		sig := []byte(proof)
+		if len(sig) != ed25519.SignatureSize {
+			// Possibly hex or base64 encoded
+			if sig, err = decodeKey(strings.TrimSpace(proof)); err != nil {
+				return errors.New("malformed ed25519 signature")
+			}
+		}
+		if !ed25519.Verify(v.publicKey, []byte(content), sig) {
+			return errors.New("ed25519 signature mismatch")
+		}
+		return nil
+	case verifyMinisign:
+		return v.verifyMinisign(content, proof)
+	default:
+		panic(fmt.Sprintf("Unexpected verification method %v", v.method))
+	}
+}
+
+// Checksum file is either a bare hex digest, or in the format of sha256sum(1) output
+// The line whose file name matches the URL takes precedence, see: https://man7.org/linux/man-pages/man1/sha256sum.1.html
+func verifySha256Sum(theUrl, content, sums string) error {
+	name := path.Base(strings.SplitN(theUrl, "?", 2)[0])
+
+	var expected string
+	for _, line := range strings.Split(sums, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || len(f[0]) != sha256.Size*2 {
+			continue
+		}
+		if len(expected) == 0 {
+			expected = f[0]
+		}
+		if len(f) > 1 && strings.TrimPrefix(f[1], "*") == name {
+			expected = f[0]
+			break
+		}
+	}
+	if len(expected) == 0 {
+		return errors.New("no sha256 checksum found")
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), expected) {
+		return errors.New(fmt.Sprintf("sha256 checksum mismatch, expected %v, got %x", expected, sum))
+	}
+	return nil
+}
+
+// Signature file format:
+//
+//	untrusted comment: COMMENT
+//	base64(signature algorithm + key ID + signature)
+//	trusted comment: COMMENT
+//	base64(global signature of the signature and the trusted comment)
+//
+// see: https://jedisct1.github.io/minisign/
+func (v *urlVerifier) verifyMinisign(content, sigFile string) error {
+	lines := strings.Split(strings.ReplaceAll(sigFile, "\r\n", "\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], "untrusted comment: ") {
+		return errors.New("malformed minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 10+ed25519.SignatureSize {
+		return errors.New("malformed minisign signature")
+	}
+	if !bytes.Equal(sig[2:10], v.keyId) {
+		return errors.New("minisign key ID mismatch")
+	}
+
+	message := []byte(content)
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		// Prehashed, which is the default since minisign 0.10
+		sum := blake2b.Sum512(message)
+		message = sum[:]
+	default:
+		return errors.New(fmt.Sprintf("unsupported minisign algorithm %q", sig[:2]))
+	}
+	if !ed25519.Verify(v.publicKey, message, sig[10:]) {
+		return errors.New("minisign signature mismatch")
+	}
+
+	const trustedPrefix = "trusted comment: "
+	if !strings.HasPrefix(lines[2], trustedPrefix) {
+		return errors.New("malformed minisign trusted comment")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return errors.New("malformed minisign global signature")
+	}
+	if !ed25519.Verify(v.publicKey, append(sig[10:], lines[2][len(trustedPrefix):]...), globalSig) {
+		return errors.New("minisign trusted comment signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package dnsredir
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/coredns/caddy"
+	"golang.org/x/crypto/blake2b"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Sign content the same way as `minisign -S'
+func minisign(priv ed25519.PrivateKey, keyId []byte, content, trustedComment string) string {
+	sum := blake2b.Sum512([]byte(content))
+	sig := append([]byte("ED"), keyId...)
+	sig = append(sig, ed25519.Sign(priv, sum[:])...)
+	globalSig := ed25519.Sign(priv, append(append([]byte{}, sig[10:]...), trustedComment...))
+	return fmt.Sprintf("untrusted comment: signature from minisign secret key\n%v\ntrusted comment: %v\n%v\n",
+		base64.StdEncoding.EncodeToString(sig), trustedComment, base64.StdEncoding.EncodeToString(globalSig))
+}
+
+func TestUrlVerifier(t *testing.T) {
+	const theUrl = "https://example.com/list.conf"
+	const content = "example.com\nexample.org\n"
+	const tampered = "example.com\nevil.example.net\n"
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyId := []byte("12345678")
+	minisignKey := base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyId...), pub...))
+	sum := sha256.Sum256([]byte(content))
+
+	proofs := map[string]string{
+		"https://example.com/list.conf.sha256":    hex.EncodeToString(sum[:]) + "\n",
+		"https://example.com/SHA256SUMS":          fmt.Sprintf("%x  other.conf\n%x *list.conf\n", sha256.Sum256(nil), sum),
+		"https://example.com/list.conf.sig":       string(ed25519.Sign(priv, []byte(content))),
+		"https://example.com/list.conf.sig.b64":   base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(content))),
+		"https://example.com/list.conf.minisig":   minisign(priv, keyId, content, "timestamp:1700000000"),
+		"https://example.com/wrong-key.minisig":   minisign(priv, []byte("87654321"), content, "foobar"),
+		"https://example.com/bad-comment.minisig": "untrusted comment: foo\nbar\n",
+	}
+	fetch := func(theUrl string) (string, error) {
+		if proof, ok := proofs[theUrl]; ok {
+			return proof, nil
+		}
+		return "", errors.New("not found")
+	}
+
+	tests := []struct {
+		args []string
+		ok   bool // Expected result of verifying genuine content
+	}{
+		{[]string{"sha256", "https://example.com/list.conf.sha256"}, true},
+		{[]string{"sha256", "https://example.com/SHA256SUMS"}, true},
+		{[]string{"sha256", "https://example.com/not-found"}, false},
+		{[]string{"ed25519", "https://example.com/list.conf.sig", hex.EncodeToString(pub)}, true},
+		{[]string{"ed25519", "https://example.com/list.conf.sig.b64", base64.StdEncoding.EncodeToString(pub)}, true},
+		{[]string{"minisign", "https://example.com/list.conf.minisig", minisignKey}, true},
+		{[]string{"minisign", "https://example.com/wrong-key.minisig", minisignKey}, false},
+		{[]string{"minisign", "https://example.com/bad-comment.minisig", minisignKey}, false},
+	}
+	for i, test := range tests {
+		o := &urlOptions{}
+		if err := o.parse(test.args[0], test.args[1:]); err != nil {
+			t.Fatalf("Test case#%v failed, parse: %v", i, err)
+		}
+		if err := o.verifier.verify(theUrl, content, fetch); (err == nil) != test.ok {
+			t.Errorf("Test case#%v failed, verify genuine content: %v", i, err)
+		}
+		if err := o.verifier.verify(theUrl, tampered, fetch); err == nil {
+			t.Errorf("Test case#%v failed, tampered content passed verification", i)
+		}
+	}
+
+	for i, args := range [][]string{
+		{"sha256"},
+		{"sha256", "http://example.com/list.conf.sha256"},
+		{"ed25519", "https://example.com/list.conf.sig", "deadbeef"},
+		{"minisign", "https://example.com/list.conf.minisig", hex.EncodeToString(pub)},
+		{"md5", "https://example.com/list.conf.md5"},
+	} {
+		if err := (&urlOptions{}).parse(args[0], args[1:]); err == nil {
+			t.Errorf("Bad option#%v %v should fail to parse", i, args)
+		}
+	}
+}
+
+func TestAttachUrlOptions(t *testing.T) {
+	const sumUrl = "https://example.com/list.conf.sha256"
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{"dnsredir abp+https://example.com/list.conf {\n to 1.1.1.1 \n url_option https://example.com/list.conf sha256 " + sumUrl + "\n}", true},
+		{"dnsredir . {\n to 1.1.1.1 \n url_option https://example.com/list.conf sha256 " + sumUrl + "\n except https://example.com/list.conf \n}", true},
+		{"dnsredir https://example.com/other.conf {\n to 1.1.1.1 \n url_option https://example.com/list.conf sha256 " + sumUrl + "\n}", false},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		ups, err := NewReloadableUpstreams(c)
+		if (err == nil) != test.ok {
+			t.Errorf("Test case#%v failed, err: %v", i, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		u := ups[0].(*reloadableUpstream)
+		items := append(u.NameList.items, u.exceptList.items...)
+		if items[0].options == nil || items[0].options.verifier.url != sumUrl {
+			t.Errorf("Test case#%v failed, url_option not attached", i)
+		}
+	}
+}
+
+func TestUrlOptionsRequest(t *testing.T) {
+	const content = "example.com\n"
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		switch {
+		case r.URL.Path == "/bearer" && r.Header.Get("Authorization") != "Bearer s3cret":
+		case r.URL.Path == "/basic" && (user != "alice" || password != "passw0rd"):
+		case r.Header.Get("X-Token") != "foo bar" || r.Header.Get("User-Agent") != "dnsredir":
+		default:
+			_, _ = w.Write([]byte(content))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("passw0rd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DNSREDIR_TEST_TOKEN", "s3cret")
+
+	common := [][]string{
+		{"ca", caFile},
+		{"header", "X-Token", "foo", "bar"},
+		{"header", "User-Agent", "dnsredir"},
+	}
+	tests := []struct {
+		path    string
+		options [][]string
+		ok      bool
+	}{
+		{"/plain", nil, true},
+		{"/bearer", [][]string{{"bearer", "env:DNSREDIR_TEST_TOKEN"}}, true},
+		{"/bearer", nil, false},
+		{"/basic", [][]string{{"basic", "alice", "file:" + passwordFile}}, true},
+		{"/basic", [][]string{{"bearer", "env:DNSREDIR_TEST_TOKEN"}}, false},
+		{"/plain", [][]string{{"max_size", "12"}}, true},
+		{"/plain", [][]string{{"max_size", "11"}}, false},
+	}
+	for i, test := range tests {
+		o := &urlOptions{}
+		for _, args := range append(common, test.options...) {
+			if err := o.parse(args[0], args[1:]); err != nil {
+				t.Fatalf("Test case#%v failed, parse %v: %v", i, args, err)
+			}
+		}
+		resp, err := getUrlContent(&urlRequest{url: server.URL + test.path, timeout: 5 * time.Second, options: o})
+		if (err == nil) != test.ok || (err == nil && resp.content != content) {
+			t.Errorf("Test case#%v failed, err: %v", i, err)
+		}
+	}
+
+	// System CA pool doesn't trust the test server
+	if _, err := getUrlContent(&urlRequest{url: server.URL + "/plain", timeout: 5 * time.Second}); err == nil {
+		t.Errorf("Untrusted server should fail")
+	}
+
+	for i, args := range [][]string{
+		{"bearer", "s3cret"},
+		{"bearer", "env:DNSREDIR_TEST_NOT_SET"},
+		{"basic", "alice", "file:" + filepath.Join(dir, "not-exist")},
+		{"ca", passwordFile},
+		{"proxy", "ftp://127.0.0.1:21"},
+		{"max_size", "-1"},
+		{"max_size", "1T"},
+	} {
+		if err := (&urlOptions{}).parse(args[0], args[1:]); err == nil {
+			t.Errorf("Bad option#%v %v should fail to parse", i, args)
+		}
+	}
+}
+
+func TestUrlOptionsRedirect(t *testing.T) {
+	const content = "example.com\n"
+	var leaked int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.Header.Get("X-Token") != "" {
+			atomic.AddInt32(&leaked, 1)
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	defer other.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/list.conf", http.StatusFound)
+		case "/cross":
+			http.Redirect(w, r, other.URL+"/list.conf", http.StatusFound)
+		case "/html":
+			// Redirection via a mismatched content type, see: fixUrl()
+			w.Header().Set("Location", other.URL+"/list.conf")
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("<html></html>"))
+		default:
+			if r.Header.Get("Authorization") != "Bearer s3cret" || r.Header.Get("X-Token") != "foo" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte(content))
+		}
+	}))
+	defer origin.Close()
+
+	t.Setenv("DNSREDIR_TEST_TOKEN", "s3cret")
+	o := &urlOptions{}
+	for _, args := range [][]string{{"bearer", "env:DNSREDIR_TEST_TOKEN"}, {"header", "X-Token", "foo"}} {
+		if err := o.parse(args[0], args[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"/same", "/cross", "/html"} {
+		r := &urlRequest{url: origin.URL + path, timeout: 5 * time.Second, options: o}
+		if path == "/html" {
+			r.contentType = "text/plain"
+		}
+		resp, err := getUrlContent(r)
+		if err != nil || resp.content != content {
+			t.Errorf("Failed to fetch %v, err: %v", path, err)
+		}
+	}
+	if n := atomic.LoadInt32(&leaked); n != 0 {
+		t.Errorf("Credentials sent to another origin %v time(s)", n)
+	}
+
+	if o.forUrl("https://example.com/list.conf", "https://example.com/list.conf.sig") != o {
+		t.Errorf("Credentials should be kept for the same origin")
+	}
+	for _, theUrl := range []string{"http://example.com/list.conf.sig", "https://example.com:8443/list.conf.sig", "https://example.org/list.conf.sig"} {
+		if o.forUrl("https://example.com/list.conf", theUrl).hasCredentials() {
+			t.Errorf("Credentials shouldn't be sent to %v", theUrl)
+		}
+	}
+}
+
+// Content taken over from an instance without the verify option must be verified even if it's unchanged
+func TestVerifyUnchangedContent(t *testing.T) {
+	const content = "example.com\n"
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sigRequests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/list.conf.sig" {
+			atomic.AddInt32(&sigRequests, 1)
+			_, _ = w.Write(ed25519.Sign(priv, []byte(content)))
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	o := &urlOptions{}
+	for _, args := range [][]string{{"ca", caFile}, {"ed25519", server.URL + "/list.conf.sig", hex.EncodeToString(pub)}} {
+		if err := o.parse(args[0], args[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := newDomainSet()
+	names.Add("example.com")
+	item := &NameItem{whichType: NameItemTypeUrl, format: nameFormatAuto, url: server.URL + "/list.conf", options: o,
+		names: names, contentHash: stringHash(content), etag: `"v1"`}
+	n := &NameList{urlReadTimeout: 5 * time.Second}
+	n.items = []*NameItem{item}
+	for i := 0; i < 2; i++ {
+		if !n.updateItemFromUrl(item, nil) {
+			t.Fatalf("Update#%v failed", i)
+		}
+	}
+	if n := atomic.LoadInt32(&sigRequests); n != 1 || !item.verified {
+		t.Errorf("Expected verified once, got %v signature request(s), verified: %v", n, item.verified)
+	}
+}
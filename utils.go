@@ -1,12 +1,13 @@
 package dnsredir
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
+	"github.com/andybalholm/brotli"
 	"github.com/coredns/coredns/plugin"
 	"hash/fnv"
 	"io"
-	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
@@ -121,27 +122,65 @@ func isContentType(contentType string, h *http.Header) bool {
 	return t == contentType || strings.Contains(t, contentType+";")
 }
 
-// bootstrap: Bootstrap DNS to resolve domain names(empty array to use system defaults)
-//
+// Request of URL content
+type urlRequest struct {
+	url string
+	// Expected content type, the response is taken as a redirection if mismatched, empty to accept any
+	contentType string
+	// Bootstrap DNS to resolve domain names(empty array to use system defaults)
+	bootstrap []string
+	timeout   time.Duration
+	// Options of the URL, nil if none
+	options *urlOptions
+
+	// Validators of previous response, for conditional request
+	etag         string
+	lastModified string
+}
+
+// Response of URL content
+type urlResponse struct {
+	content string
+	// Content unchanged since previous response, i.e. 304 Not Modified
+	notModified bool
+
+	etag         string
+	lastModified string
+}
+
+// Same as the default policy of http.Client
+const maxRedirects = 10
+
 // see:
 //	https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
 //	https://medium.com/@nate510/don-t-use-go-s-default-http-client-4804cb19f779
-func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.Duration) (string, error) {
+func getUrlContent(r *urlRequest) (*urlResponse, error) {
 	var transport http.RoundTripper
 
-	if len(bootstrap) != 0 {
-		resolver := &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				var d net.Dialer
-				// Randomly choose a bootstrap DNS to resolve upstream host(if any)
-				addr := bootstrap[rand.Intn(len(bootstrap))]
-				return d.DialContext(ctx, network, addr)
-			},
-		}
+	options := r.options
+	if options == nil {
+		options = &urlOptions{}
+	}
+	if len(r.bootstrap) != 0 || options.tlsConfig != nil || options.proxy != nil {
 		dialer := &net.Dialer{
-			Timeout:  timeout,
-			Resolver: resolver,
+			Timeout: r.timeout,
+		}
+		if len(r.bootstrap) != 0 {
+			dialer.Resolver = &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					var d net.Dialer
+					// Randomly choose a bootstrap DNS to resolve upstream host(if any)
+					addr := r.bootstrap[rand.Intn(len(r.bootstrap))]
+					return d.DialContext(ctx, network, addr)
+				},
+			}
+		} else {
+			// Fallback to use system default resolvers, which located at /etc/resolv.conf
+		}
+		proxy := http.ProxyFromEnvironment
+		if options.proxy != nil {
+			proxy = http.ProxyURL(options.proxy)
 		}
 		// see: http.DefaultTransport
 		transport = &http.Transport{
@@ -150,48 +189,124 @@ func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.
 			IdleConnTimeout:       90 * time.Second,
 			MaxIdleConns:          100,
 			MaxIdleConnsPerHost:   10,
-			Proxy:                 http.ProxyFromEnvironment,
-			TLSHandshakeTimeout:   timeout,
+			Proxy:                 proxy,
+			TLSClientConfig:       options.tlsConfig,
+			TLSHandshakeTimeout:   r.timeout,
 		}
-	} else {
-		// Fallback to use system default resolvers, which located at /etc/resolv.conf
 	}
 
-	req, err := http.NewRequest(http.MethodGet, theUrl, nil)
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	// Set a fake user agent in case of access denied error
+	// Set a fake user agent in case of access denied error, can be overridden by url_option header
 	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:80.0) Gecko/20100101 Firefox/80.0")
+	if err := options.apply(req); err != nil {
+		return nil, err
+	}
+	// Transparent decompression is disabled once Accept-Encoding is set, see: decodeBody()
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	if len(r.etag) != 0 {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	if len(r.lastModified) != 0 {
+		req.Header.Set("If-Modified-Since", r.lastModified)
+	}
 
+	// Redirections to other origins are followed manually without credentials, see below
+	crossOrigin := false
 	c := &http.Client{
 		Transport: transport, // [sic] If nil, DefaultTransport is used.
-		Timeout:   timeout,   // Q: Should we omit this field if transport isn't nil?
+		Timeout:   r.timeout, // Q: Should we omit this field if transport isn't nil?
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %v redirects", maxRedirects)
+			}
+			if options.hasCredentials() && !sameOrigin(req.URL, via[0].URL) {
+				crossOrigin = true
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
 	}
 	resp, err := c.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer Close(resp.Body)
 
+	if crossOrigin {
+		location, err := resp.Location()
+		if err != nil {
+			return nil, err
+		}
+		r1 := *r
+		r1.url = location.String()
+		r1.options = options.withoutCredentials()
+		r1.etag = ""
+		r1.lastModified = ""
+		return getUrlContent(&r1)
+	}
+
+	if resp.StatusCode == http.StatusNotModified && (len(r.etag) != 0 || len(r.lastModified) != 0) {
+		return &urlResponse{
+			notModified:  true,
+			etag:         r.etag,
+			lastModified: r.lastModified,
+		}, nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("bad status code: %v", resp.StatusCode)
+		return nil, fmt.Errorf("bad status code: %v", resp.StatusCode)
 	}
 
-	if len(contentType) != 0 && !isContentType(contentType, &resp.Header) {
-		if theUrl, err = fixUrl(theUrl, resp.Header); err != nil {
-			return "", err
-		} else {
-			return getUrlContent(theUrl, contentType, bootstrap, timeout)
+	if len(r.contentType) != 0 && !isContentType(r.contentType, &resp.Header) {
+		theUrl, err := fixUrl(r.url, resp.Header)
+		if err != nil {
+			return nil, err
 		}
+		r1 := *r
+		r1.url = theUrl
+		r1.options = r.options.forUrl(r.url, theUrl)
+		return getUrlContent(&r1)
 	}
 
-	content, err := ioutil.ReadAll(resp.Body)
+	body, err := decodeBody(resp)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	defer Close(body)
+	var reader io.Reader = body
+	if options.maxSize > 0 {
+		// One more byte to tell if the limit exceeded
+		reader = io.LimitReader(body, options.maxSize+1)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if options.maxSize > 0 && int64(len(content)) > options.maxSize {
+		return nil, fmt.Errorf("response body exceeds %v bytes", options.maxSize)
 	}
 	// We don't use http.DetectContentType()
-	return string(content), nil
+	return &urlResponse{
+		content:      string(content),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// Decode response body as per Content-Encoding
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+		return io.NopCloser(resp.Body), nil
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	case "br":
+		return io.NopCloser(brotli.NewReader(resp.Body)), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
 }
 
 func fixUrl(theUrl string, h http.Header) (string, error) {
@@ -1,7 +1,13 @@
 package dnsredir
 
 import (
+	"bytes"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestStringToDomain(t *testing.T) {
@@ -59,3 +65,59 @@ func TestStringToDomain(t *testing.T) {
 		}
 	}
 }
+
+func TestGetUrlContent(t *testing.T) {
+	const content = "example.com\nexample.org\n"
+	const etag = `"v1"`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		var buf bytes.Buffer
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(&buf)
+			_, _ = zw.Write([]byte(content))
+			_ = zw.Close()
+		case "/br":
+			w.Header().Set("Content-Encoding", "br")
+			bw := brotli.NewWriter(&buf)
+			_, _ = bw.Write([]byte(content))
+			_ = bw.Close()
+		default:
+			buf.WriteString(content)
+		}
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/plain", "/gzip", "/br"} {
+		req := &urlRequest{
+			url:         server.URL + path,
+			contentType: "text/plain",
+			timeout:     5 * time.Second,
+		}
+		resp, err := getUrlContent(req)
+		if err != nil {
+			t.Fatalf("%v: getUrlContent() failed: %v", path, err)
+		}
+		if resp.notModified || resp.content != content || resp.etag != etag {
+			t.Errorf("%v: unexpected response %+v", path, resp)
+		}
+
+		req.etag = resp.etag
+		resp, err = getUrlContent(req)
+		if err != nil {
+			t.Fatalf("%v: getUrlContent() failed: %v", path, err)
+		}
+		if !resp.notModified || resp.etag != etag {
+			t.Errorf("%v: expected not modified, got %+v", path, resp)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Created Oct 18, 2026
+ */
+
+package dnsredir
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Editors and package managers usually write a file in several steps, wait for the burst to settle down
+	watchDebounce = 200 * time.Millisecond
+	// Watched files are still polled, in case of any event is lost, e.g. files on network file systems
+	watchedPollInterval = 1 * time.Minute
+)
+
+type watchSub struct {
+	notify func()
+	timer  *time.Timer
+}
+
+// One watcher serves the whole process, directories are watched rather than files,
+// so atomic replaces(i.e. write to a temporary file and rename it over) can be caught
+var fileWatcher = struct {
+	sync.Mutex
+	w *fsnotify.Watcher
+	// Reference count of each watched directory
+	dirs map[string]int
+	// Subscribers of each watched file or directory
+	subs map[string]map[*watchSub]struct{}
+}{
+	dirs: make(map[string]int),
+	subs: make(map[string]map[*watchSub]struct{}),
+}
+
+// Watch a file for writes, creations, renames and removals
+// notify() is called after a burst of events settled down
+// Return a function to cancel the watch
+func watchFile(path string, notify func()) (func(), error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	return watch(path, filepath.Dir(path), notify)
+}
+
+// Watch a directory for changes of any file in it, see: watchFile()
+func watchDir(dir string, notify func()) (func(), error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return watch(dir, dir, notify)
+}
+
+// Subscribe to events of `path', by watching the directory `dir'
+func watch(path, dir string, notify func()) (func(), error) {
+	fileWatcher.Lock()
+	defer fileWatcher.Unlock()
+
+	if fileWatcher.w == nil {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		fileWatcher.w = w
+		go watchLoop(w)
+	}
+
+	if fileWatcher.dirs[dir] == 0 {
+		if err := fileWatcher.w.Add(dir); err != nil {
+			return nil, err
+		}
+	}
+	fileWatcher.dirs[dir]++
+
+	sub := &watchSub{notify: notify}
+	if fileWatcher.subs[path] == nil {
+		fileWatcher.subs[path] = make(map[*watchSub]struct{})
+	}
+	fileWatcher.subs[path][sub] = struct{}{}
+
+	return func() {
+		fileWatcher.Lock()
+		defer fileWatcher.Unlock()
+
+		if _, ok := fileWatcher.subs[path][sub]; !ok {
+			// Already cancelled
+			return
+		}
+		if sub.timer != nil {
+			sub.timer.Stop()
+		}
+		delete(fileWatcher.subs[path], sub)
+		if len(fileWatcher.subs[path]) == 0 {
+			delete(fileWatcher.subs, path)
+		}
+
+		if fileWatcher.dirs[dir]--; fileWatcher.dirs[dir] == 0 {
+			delete(fileWatcher.dirs, dir)
+			if err := fileWatcher.w.Remove(dir); err != nil {
+				log.Debugf("Failed to unwatch %q, err: %v", dir, err)
+			}
+		}
+	}, nil
+}
+
+func watchLoop(w *fsnotify.Watcher) {
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Rename) && !ev.Has(fsnotify.Remove) {
+				continue
+			}
+
+			name := filepath.Clean(ev.Name)
+			fileWatcher.Lock()
+			// Subscribers of the file itself, and of its directory
+			for _, path := range []string{name, filepath.Dir(name)} {
+				for sub := range fileWatcher.subs[path] {
+					if sub.timer == nil {
+						sub.timer = time.AfterFunc(watchDebounce, sub.notify)
+					} else {
+						sub.timer.Reset(watchDebounce)
+					}
+				}
+			}
+			fileWatcher.Unlock()
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			// Events may be lost(e.g. queue overflow), polling will catch up
+			log.Warningf("File watcher error: %v", err)
+		}
+	}
+}
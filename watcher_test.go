@@ -0,0 +1,130 @@
+package dnsredir
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "list.conf")
+	if err := os.WriteFile(path, []byte("example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int32
+	notified := make(chan struct{}, 8)
+	cancel, err := watchFile(path, func() {
+		atomic.AddInt32(&count, 1)
+		notified <- struct{}{}
+	})
+	if err != nil {
+		t.Fatalf("watchFile() failed: %v", err)
+	}
+	// Another subscriber of the same directory
+	cancel2, err := watchFile(filepath.Join(dir, "other.conf"), func() {})
+	if err != nil {
+		t.Fatalf("watchFile() failed: %v", err)
+	}
+	defer cancel2()
+
+	wait := func(what string) {
+		select {
+		case <-notified:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No notification after %v", what)
+		}
+	}
+
+	// A burst of writes is debounced into one notification
+	for i := 0; i < 5; i++ {
+		if err := os.WriteFile(path, []byte("example.org\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wait("writes")
+	time.Sleep(2 * watchDebounce)
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Errorf("Expected 1 notification, got %v", n)
+	}
+
+	// Atomic replace
+	tmp := filepath.Join(dir, ".list.conf.tmp")
+	if err := os.WriteFile(tmp, []byte("example.net\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	wait("atomic replace")
+
+	cancel()
+	cancel()
+	fileWatcher.Lock()
+	refs := fileWatcher.dirs[dir]
+	fileWatcher.Unlock()
+	if refs != 1 {
+		t.Errorf("Expected directory reference count 1, got %v", refs)
+	}
+	if err := os.WriteFile(path, []byte("example.info\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-notified:
+		t.Errorf("Notified after the watch cancelled")
+	case <-time.After(2 * watchDebounce):
+	}
+}
+
+// Kubernetes ConfigMap volumes swap the ..data symlink, files themselves are symlinks into it
+func TestWatchSymlink(t *testing.T) {
+	dir := t.TempDir()
+	for _, v := range []string{"v1", "v2"} {
+		if err := os.Mkdir(filepath.Join(dir, v), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, v, "list.conf"), []byte(v+".example.com\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "list.conf")
+	if err := os.Symlink(filepath.Join("..data", "list.conf"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := NewNameItemsWithForms([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &NameList{}
+	n.addItems(items)
+	changed := make(chan struct{}, 1)
+	cancels, allWatched := n.watchPaths(changed)
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	if allWatched {
+		t.Errorf("Symbolic links should be polled as well")
+	}
+
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink("v2", tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No notification after the symlink swapped")
+	}
+}